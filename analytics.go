@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/MakeNowJust/heredoc"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	sessionCookie    = "sg_sid"
+	sessionCookieAge = 365 * 24 * 60 * 60
+	searchIdHeader   = "X-Search-Id"
+	queryLogBuffer   = 1000
+)
+
+// SearchQueryLog is one suggestion request as recorded for analytics.
+type SearchQueryLog struct {
+	SearchID  string
+	Term      string
+	SessionID string
+	Counts    map[string]int // total matches per vertical
+	Latency   time.Duration
+}
+
+var queryLog chan (SearchQueryLog)
+
+func prepareAnalytics() {
+	queryLog = make(chan SearchQueryLog, queryLogBuffer)
+	go writeQueryLog()
+}
+
+// logSearchQuery hands a query to the analytics writer. Analytics must
+// never slow down suggestions, so the entry is dropped when the buffer is
+// full.
+func logSearchQuery(entry SearchQueryLog) {
+	select {
+	case queryLog <- entry:
+	default:
+		fmt.Println("search analytics buffer full, dropping", entry.SearchID)
+	}
+}
+
+func writeQueryLog() {
+	for entry := range queryLog {
+		total := 0
+		for _, n := range entry.Counts {
+			total += n
+		}
+		counts, _ := json.Marshal(entry.Counts)
+		_, err := dbx.Exec(`
+			INSERT INTO search_queries (search_id, term, normalized, session_id, counts, total, latency_ms)
+			VALUES ($1, $2, $3, $4, $5::jsonb, $6, $7)
+			ON CONFLICT DO NOTHING`,
+			entry.SearchID, entry.Term, normalizeTerm(entry.Term), entry.SessionID, string(counts), total,
+			int(entry.Latency/time.Millisecond))
+		if err != nil {
+			fmt.Println("Unable to log search query:", err)
+		}
+	}
+}
+
+// sessionID returns the anonymous session of the caller, issuing a new
+// cookie on the first visit.
+func sessionID(c *gin.Context) string {
+	if sid, err := c.Cookie(sessionCookie); err == nil && sid != "" {
+		return sid
+	}
+	sid := randomID()
+	c.SetCookie(sessionCookie, sid, sessionCookieAge, "/", "", false, true)
+	return sid
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// processSearchClick records the suggestion a user picked. It is meant for
+// navigator.sendBeacon, so it accepts JSON as well as form posts.
+func processSearchClick(c *gin.Context) {
+	var click struct {
+		SearchID string `json:"search_id" form:"search_id" binding:"required"`
+		Vertical string `json:"vertical" form:"vertical" binding:"required"`
+		Href     string `json:"href" form:"href" binding:"required"`
+		Position int    `json:"position" form:"position"`
+	}
+	if err := c.ShouldBind(&click); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err := dbx.Exec(`
+		INSERT INTO search_clicks (search_id, session_id, vertical, href, position)
+		VALUES ($1, $2, $3, $4, $5)`,
+		click.SearchID, sessionID(c), click.Vertical, click.Href, click.Position)
+	if err != nil {
+		fmt.Println("Unable to log search click:", err)
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// QueryReportRow is one line of the search analytics reports.
+type QueryReportRow struct {
+	Term     string  `db:"term" json:"term"`
+	Searches int     `db:"searches" json:"searches"`
+	Sessions int     `db:"sessions" json:"sessions"`
+	Clicks   int     `db:"clicks" json:"clicks"`
+	CTR      float64 `db:"ctr" json:"ctr"`
+}
+
+// searchReport serves the merchandiser reports:
+//
+//	top           most searched terms
+//	zero-results  terms that found nothing in any vertical
+//	ctr           terms by click-through rate, worst first
+func searchReport(c *gin.Context) {
+	days, err := strconv.Atoi(c.DefaultQuery("days", "7"))
+	if err != nil || days < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad days"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad limit"})
+		return
+	}
+
+	where, order := "", "searches DESC"
+	switch c.Param("report") {
+	case "top":
+	case "zero-results":
+		where = "AND q.total = 0"
+	case "ctr":
+		order = "ctr ASC, searches DESC"
+	default:
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown report"})
+		return
+	}
+
+	request := heredoc.Docf(`
+		WITH clicked AS (SELECT DISTINCT search_id FROM search_clicks)
+		SELECT q.normalized AS term,
+			COUNT(1) AS searches,
+			COUNT(DISTINCT q.session_id) AS sessions,
+			COUNT(clicked.search_id) AS clicks,
+			COUNT(clicked.search_id)::float8 / COUNT(1) AS ctr
+		FROM search_queries q
+		LEFT JOIN clicked ON clicked.search_id = q.search_id
+		WHERE q.created_at > now() - interval '%d days' %s
+		GROUP BY q.normalized
+		ORDER BY %s
+		LIMIT %d
+	`, days, where, order, limit)
+
+	rows := []QueryReportRow{}
+	if err = dbx.Select(&rows, request); err != nil {
+		fmt.Println("search report error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to build report"})
+		return
+	}
+	c.JSON(http.StatusOK, rows)
+}
@@ -0,0 +1,62 @@
+package main
+
+import "context"
+
+// SearchBackend finds and hydrates the items of a suggestion vertical.
+// Every implementation applies the same rules: ready/visible products,
+// validity windows, hidden sales unless final-sale, no delivery products,
+// no adults-only items and the vertical's own where condition.
+type SearchBackend interface {
+	// SearchIds returns the number of matches for term and the ids of the
+	// best v.Limit of them in v.Order. An empty term lists the newest items.
+	SearchIds(ctx context.Context, v *Vertical, term string) (total int, ids []int)
+
+	// FuzzySearchIds is SearchIds tolerating typos in term.
+	FuzzySearchIds(ctx context.Context, v *Vertical, term string) FuzzyResult
+
+	// Items hydrates ids, keeping their order and skipping unknown ones.
+	Items(ctx context.Context, v *Vertical, ids []int) SearchSuggestions
+}
+
+// postgresBackend runs the search SQL against searchDB.
+type postgresBackend struct{}
+
+func (postgresBackend) SearchIds(ctx context.Context, v *Vertical, term string) (total int, ids []int) {
+	switch v.Source {
+	case sourceShopProducts:
+		return ShopProductSearchIds(ctx, term, v.Limit, v.Where, v.Order)
+	case sourceCategories:
+		return CategorySearchIds(ctx, term, v.Limit)
+	}
+	return ProductSearchIds(ctx, term, v.Limit, v.Where, v.Order)
+}
+
+func (postgresBackend) FuzzySearchIds(ctx context.Context, v *Vertical, term string) FuzzyResult {
+	switch v.Source {
+	case sourceShopProducts:
+		return ShopProductFuzzySearchIds(ctx, term, v.Limit, v.Where)
+	case sourceCategories:
+		return FuzzyResult{} // names are short enough for prefixes alone
+	}
+	return ProductFuzzySearchIds(ctx, term, v.Limit, v.Where)
+}
+
+func (postgresBackend) Items(ctx context.Context, v *Vertical, ids []int) SearchSuggestions {
+	switch v.Source {
+	case sourceShopProducts:
+		return filterShopProducts(ctx, ids)
+	case sourceCategories:
+		return filterCategories(ctx, ids)
+	}
+	return filterCoupons(ctx, ids)
+}
+
+// backend is the in-memory suggestion index once it is built, Postgres
+// otherwise. Previews go to Postgres: the index only holds what is valid
+// from now on.
+func backend(ctx context.Context) SearchBackend {
+	if _, preview := isPreview(ctx); !preview && suggestionIndex.Ready() {
+		return suggestionIndex
+	}
+	return postgresBackend{}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// backendFixture is one row. Start and End are seconds relative to the
+// current business time.
+type backendFixture struct {
+	ID        int
+	Source    string
+	Title     string
+	Vacation  bool
+	Start     int
+	End       int
+	Undated   bool // no start at all
+	Unready   bool
+	SaleID    int
+	Hidden    bool
+	FinalSale bool
+	Delivery  bool
+}
+
+var backendFixtures = []backendFixture{
+	{ID: 1, Source: sourceProducts, Title: "Spa weekend in Eilat", Start: -86400, End: 86400},
+	{ID: 2, Source: sourceProducts, Title: "Spanish tapas dinner", Start: -3600, End: 86400},
+	{ID: 3, Source: sourceProducts, Title: "Dead Sea spa hotel", Vacation: true, Start: -86400, End: 86400},
+	{ID: 4, Source: sourceProducts, Title: "Spa day expired", Start: -86400, End: -3600},
+	{ID: 5, Source: sourceProducts, Title: "Spa day tomorrow", Start: 3600, End: 86400},
+	{ID: 6, Source: sourceProducts, Title: "ספא בים המלח", Start: -7200, End: 86400},
+	{ID: 7, Source: sourceProducts, Title: "Birthday party boat", Start: -7200, End: 86400},
+	{ID: 8, Source: sourceProducts, Title: "The escape room", Start: -7200, End: 86400},
+	{ID: 9, Source: sourceProducts, Title: "Spa day undated", Undated: true, End: 86400},
+	{ID: 15, Source: sourceProducts, Title: "Spa night draft", Unready: true, Start: -7200, End: 86400},
+
+	{ID: 10, Source: sourceShopProducts, Title: "Spa robe", SaleID: 100, Start: -86400, End: 86400},
+	{ID: 11, Source: sourceShopProducts, Title: "Spark plug", SaleID: 100, Start: -86400, End: 86400},
+	{ID: 12, Source: sourceShopProducts, Title: "Spa towel", SaleID: 101, Hidden: true, Start: -86400, End: 86400},
+	{ID: 13, Source: sourceShopProducts, Title: "Spa slippers", SaleID: 101, Hidden: true, FinalSale: true, Start: -86400, End: 86400},
+	{ID: 14, Source: sourceShopProducts, Title: "Spa delivery", SaleID: 100, Delivery: true, Start: -86400, End: 86400},
+}
+
+var backendVerticals = map[string]*Vertical{
+	"coupons":   {Name: "coupons", Source: sourceProducts, Where: "vacation = 'f'", Limit: 3, Order: orderRank},
+	"vacations": {Name: "vacations", Source: sourceProducts, Where: "vacation = 't'", Limit: 3, Order: orderRank},
+	"shop":      {Name: "shop", Source: sourceShopProducts, Limit: 6, Order: orderNewest},
+}
+
+var backendTests = []struct {
+	vertical string
+	term     string
+	fuzzy    bool
+	total    int
+	ids      []int // in order for newest verticals, as a set otherwise
+	titles   []string
+	correct  string
+}{
+	{vertical: "coupons", term: "spa", total: 2, ids: []int{1, 2}},
+	{vertical: "vacations", term: "spa", total: 1, ids: []int{3}, titles: []string{"Dead Sea spa hotel"}},
+	{vertical: "coupons", term: "spa wee", total: 1, ids: []int{1}},
+	{vertical: "coupons", term: "אפס", total: 1, ids: []int{6}, titles: []string{"ספא בים המלח"}},
+	{vertical: "coupons", term: "party", total: 1, ids: []int{7}},
+	{vertical: "coupons", term: "the", total: 1, ids: []int{8}},
+	{vertical: "coupons", term: "", total: 5, ids: []int{8, 7, 6}},
+	{vertical: "coupons", term: "xyz", total: 0},
+	{vertical: "shop", term: "spa", total: 3, ids: []int{13, 11, 10}, titles: []string{"Spa slippers", "Spark plug", "Spa robe"}},
+	{vertical: "shop", term: "", total: 3, ids: []int{13, 11, 10}},
+	{vertical: "coupons", term: "tapaz", fuzzy: true, total: 1, ids: []int{2}, correct: "tapas"},
+}
+
+func TestMemoryBackend(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	idx := newSuggestionIndex(func() time.Time { return now })
+	for _, v := range backendVerticals {
+		var candidates []*indexCandidate
+		for _, f := range backendFixtures {
+			if f.inVertical(v) {
+				candidates = append(candidates, &indexCandidate{
+					SearchSuggestion: SearchSuggestion{ID: f.ID, Title: f.Title, SaleID: f.SaleID},
+					StartsAt:         pq.NullTime{Time: now.Add(time.Duration(f.Start) * time.Second), Valid: !f.Undated},
+					EndsAt:           now.Add(time.Duration(f.End) * time.Second),
+					Ready:            !f.Unready,
+					Hidden:           f.Hidden,
+					FinalSale:        f.FinalSale,
+					Delivery:         f.Delivery,
+				})
+			}
+		}
+		idx.Load(v.Name, indexItems(candidates))
+	}
+	runBackendTests(t, idx)
+}
+
+func TestPostgresBackend(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	conn := openTestSchema(t, url)
+	defer conn.Close()
+
+	schema, err := ioutil.ReadFile("testdata/search_schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	statements := []string{string(schema)}
+	sales := map[int]bool{}
+	now := localTimestamp()
+	for _, f := range backendFixtures {
+		start := timestampSQL(now.Add(time.Duration(f.Start) * time.Second))
+		if f.Undated {
+			start = "NULL"
+		}
+		window := fmt.Sprintf("%s, %s", start, timestampSQL(now.Add(time.Duration(f.End)*time.Second)))
+		if f.Source == sourceProducts {
+			statements = append(statements, fmt.Sprintf(
+				`INSERT INTO products (id, title, system_name, vacation, ready, valid_from, valid_until, tsv)
+				VALUES (%d, '%s', 'p%d', %t, %t, %s, to_tsvector('simple', '%s'))`,
+				f.ID, f.Title, f.ID, f.Vacation, !f.Unready, window, f.Title))
+			continue
+		}
+		if !sales[f.SaleID] {
+			sales[f.SaleID] = true
+			statements = append(statements, fmt.Sprintf(
+				`INSERT INTO shop_sales (id, hidden, start_date, end_date) VALUES (%d, %t, %s)`, f.SaleID, f.Hidden, window))
+		}
+		statements = append(statements,
+			fmt.Sprintf(`INSERT INTO shop_products (id, title, sale_id, delivery_product, tsv)
+				VALUES (%d, '%s', %d, %t, to_tsvector('simple', '%s'))`, f.ID, f.Title, f.SaleID, f.Delivery, f.Title),
+			fmt.Sprintf(`INSERT INTO shop_option_types (product_id) VALUES (%d)`, f.ID),
+			fmt.Sprintf(`INSERT INTO shop_catalogs (option_type_id) SELECT id FROM shop_option_types WHERE product_id = %d`, f.ID))
+		if f.FinalSale {
+			statements = append(statements, fmt.Sprintf(
+				`INSERT INTO shop_products_sub_categories (product_id, sub_category_id) VALUES (%d, 1)`, f.ID))
+		}
+	}
+	for _, s := range statements {
+		if _, err := conn.Exec(s); err != nil {
+			t.Fatalf("%v\n%s", err, s)
+		}
+	}
+
+	saved, savedSearch := dbx, searchDB
+	dbx, searchDB = conn, conn
+	defer func() { dbx, searchDB = saved, savedSearch }()
+	runBackendTests(t, postgresBackend{})
+}
+
+// openTestSchema connects to url with a scratch schema first on the
+// search_path, so search_schema.sql never touches existing tables. The
+// schema is dropped once the test is done.
+func openTestSchema(t *testing.T, url string) *sqlx.DB {
+	dsn, err := connectionString(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err := sqlx.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fmt.Sprintf("search_test_%d", os.Getpid())
+	if _, err = admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		admin.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`); err != nil {
+			t.Error(err)
+		}
+		admin.Close()
+	})
+
+	conn, err := sqlx.Open("postgres", fmt.Sprintf("%s search_path='%s,public'", dsn, schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// inVertical stands in for the vertical's where, the one rule left to
+// SQL; eligible decides the rest.
+func (f backendFixture) inVertical(v *Vertical) bool {
+	if f.Source != v.Source {
+		return false
+	}
+	return f.Source == sourceShopProducts || f.Vacation == (v.Where == "vacation = 't'")
+}
+
+func runBackendTests(t *testing.T, b SearchBackend) {
+	savedRanking, savedFuzzy := currentRanking(), fuzzy
+	setRanking(textOnlyRanking)
+	fuzzy = defaultFuzzy
+	defer func() { setRanking(savedRanking); fuzzy = savedFuzzy }()
+
+	ctx := context.Background()
+	for _, tt := range backendTests {
+		v := backendVerticals[tt.vertical]
+		name := fmt.Sprintf("%s/%q", tt.vertical, tt.term)
+
+		var (
+			total int
+			ids   []int
+		)
+		if tt.fuzzy {
+			result := b.FuzzySearchIds(ctx, v, tt.term)
+			total, ids = result.Total, result.Ids
+			if result.Corrected != tt.correct {
+				t.Errorf("%s: corrected = %q, want %q", name, result.Corrected, tt.correct)
+			}
+		} else {
+			total, ids = b.SearchIds(ctx, v, tt.term)
+		}
+
+		if total != tt.total {
+			t.Errorf("%s: total = %d, want %d", name, total, tt.total)
+		}
+		got, want := ids, tt.ids
+		if v.Order == orderRank && tt.term != "" {
+			got, want = sortedIds(got), sortedIds(want)
+		}
+		if len(got) != 0 || len(want) != 0 {
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: ids = %v, want %v", name, got, want)
+			}
+		}
+
+		if tt.titles != nil {
+			var titles []string
+			for _, x := range b.Items(ctx, v, ids) {
+				titles = append(titles, x.Title)
+			}
+			if strings.Join(titles, "|") != strings.Join(tt.titles, "|") {
+				t.Errorf("%s: titles = %q, want %q", name, titles, tt.titles)
+			}
+		}
+	}
+}
+
+func sortedIds(ids []int) []int {
+	sorted := append([]int(nil), ids...)
+	sort.Ints(sorted)
+	return sorted
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yvasiyarov/go-metrics"
+)
+
+// Why a webhook request was turned away.
+const (
+	shedBusy     = "busy"      // no slot freed within WEBHOOK_QUEUE_WAIT
+	shedBytes    = "bytes"     // WEBHOOK_MAX_IN_FLIGHT_BYTES reached
+	shedTooLarge = "too_large" // body over WEBHOOK_MAX_BODY_BYTES
+	shedBacklog  = "backlog"   // WEBHOOK_MAX_QUEUED_EVENTS waiting in event_jobs
+)
+
+// webhookShed counts, per reason, the webhook requests turned away. They
+// are reported to New Relic as webhook/shed/<reason>.
+var webhookShed = map[string]metrics.Counter{
+	shedBusy:     metrics.NewCounter(),
+	shedBytes:    metrics.NewCounter(),
+	shedTooLarge: metrics.NewCounter(),
+	shedBacklog:  metrics.NewCounter(),
+}
+
+const queuedEventsInterval = 5 * time.Second
+
+var (
+	webhookSlots chan struct{}
+	webhookBytes int64 // body bytes of the admitted requests, atomic
+	queuedEvents int64 // event_jobs as last counted, atomic
+)
+
+func prepareBackpressure() {
+	webhookSlots = make(chan struct{}, config.Webhook.MaxConcurrent)
+	if config.Webhook.MaxQueuedEvents > 0 {
+		go refreshQueuedEvents()
+	}
+}
+
+// refreshQueuedEvents counts the waiting events, up to one past the limit
+// as that is all the webhook needs to know.
+func refreshQueuedEvents() {
+	for {
+		var n int64
+		request := `SELECT count(1) FROM (SELECT 1 FROM event_jobs LIMIT $1) AS backlog`
+		if err := dbx.Get(&n, request, config.Webhook.MaxQueuedEvents+1); err != nil {
+			fmt.Println("Unable to count queued events:", err)
+		} else {
+			atomic.StoreInt64(&queuedEvents, n)
+		}
+		time.Sleep(queuedEventsInterval)
+	}
+}
+
+// webhookBackpressure admits a webhook request when the queue has room,
+// its body fits what the admitted ones leave of WEBHOOK_MAX_IN_FLIGHT_BYTES
+// and a slot frees up soon enough. A body of unknown length is counted
+// as the largest allowed and cut there.
+func webhookBackpressure() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		size := c.Request.ContentLength
+		if size > int64(config.Webhook.MaxBodyBytes) {
+			shedRequest(c, shedTooLarge, http.StatusRequestEntityTooLarge)
+			return
+		}
+		if size < 0 {
+			size = int64(config.Webhook.MaxBodyBytes)
+		}
+		if limit := config.Webhook.MaxQueuedEvents; limit > 0 && atomic.LoadInt64(&queuedEvents) >= int64(limit) {
+			shedRequest(c, shedBacklog, http.StatusServiceUnavailable)
+			return
+		}
+		if atomic.AddInt64(&webhookBytes, size) > int64(config.Webhook.MaxInFlightBytes) {
+			atomic.AddInt64(&webhookBytes, -size)
+			shedRequest(c, shedBytes, http.StatusTooManyRequests)
+			return
+		}
+		defer atomic.AddInt64(&webhookBytes, -size)
+
+		if !acquireWebhookSlot(c.Request.Context()) {
+			shedRequest(c, shedBusy, http.StatusServiceUnavailable)
+			return
+		}
+		defer func() { <-webhookSlots }()
+
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, size)
+		c.Next()
+	}
+}
+
+func acquireWebhookSlot(ctx context.Context) bool {
+	select {
+	case webhookSlots <- struct{}{}:
+		return true
+	default:
+	}
+	wait := time.NewTimer(config.Webhook.QueueWait)
+	defer wait.Stop()
+	select {
+	case webhookSlots <- struct{}{}:
+		return true
+	case <-wait.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// shedRequest turns c away, asking SendGrid to post it again after
+// WEBHOOK_RETRY_AFTER unless it will never fit.
+func shedRequest(c *gin.Context, reason string, status int) {
+	webhookShed[reason].Inc(1)
+	if status != http.StatusRequestEntityTooLarge {
+		retryLater(c)
+	}
+	c.AbortWithStatusJSON(status, gin.H{"error": http.StatusText(status), "reason": reason})
+}
+
+func retryLater(c *gin.Context) {
+	c.Header("Retry-After", strconv.Itoa(int(config.Webhook.RetryAfter/time.Second)))
+}
+
+// webhookShedMetrica reports a webhookShed counter per harvest.
+type webhookShedMetrica struct {
+	reason string
+}
+
+func (m webhookShedMetrica) GetName() string  { return "webhook/shed/" + m.reason }
+func (m webhookShedMetrica) GetUnits() string { return "requests" }
+
+func (m webhookShedMetrica) GetValue() (float64, error) {
+	counter := webhookShed[m.reason]
+	n := counter.Count()
+	counter.Dec(n)
+	return float64(n), nil
+}
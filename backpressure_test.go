@@ -0,0 +1,181 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// webhookTestLimits allows 2 requests at once, 100 byte bodies, 150 bytes
+// in flight, a 10ms wait for a slot and 3 queued events.
+func webhookTestLimits(t *testing.T) {
+	saved := config
+	config.Webhook.MaxConcurrent = 2
+	config.Webhook.QueueWait = 10 * time.Millisecond
+	config.Webhook.MaxBodyBytes = 100
+	config.Webhook.MaxInFlightBytes = 150
+	config.Webhook.MaxQueuedEvents = 3
+	config.Webhook.RetryAfter = 30 * time.Second
+	webhookSlots = make(chan struct{}, config.Webhook.MaxConcurrent)
+	atomic.StoreInt64(&webhookBytes, 0)
+	atomic.StoreInt64(&queuedEvents, 0)
+	t.Cleanup(func() {
+		config = saved
+		atomic.StoreInt64(&queuedEvents, 0)
+	})
+}
+
+func webhookTestRouter(handler gin.HandlerFunc) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/sendgrid_event", webhookBackpressure(), handler)
+	return r
+}
+
+func postWebhook(r http.Handler, body string, length int64) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/api/sendgrid_event", strings.NewReader(body))
+	req.ContentLength = length
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// holdWebhook posts body and keeps its handler running until the returned
+// release is called.
+func holdWebhook(t *testing.T, body string) (release func()) {
+	entered, done, finished := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	r := webhookTestRouter(func(c *gin.Context) {
+		close(entered)
+		<-done
+		c.Status(http.StatusOK)
+	})
+	go func() {
+		defer close(finished)
+		postWebhook(r, body, int64(len(body)))
+	}()
+	select {
+	case <-entered:
+	case <-time.After(time.Second):
+		t.Fatal("the held request was not admitted")
+	}
+	return func() { close(done); <-finished }
+}
+
+func assertWebhookIdle(t *testing.T) {
+	t.Helper()
+	if n := atomic.LoadInt64(&webhookBytes); n != 0 {
+		t.Errorf("%d bytes still counted in flight", n)
+	}
+	if n := len(webhookSlots); n != 0 {
+		t.Errorf("%d slots still taken", n)
+	}
+}
+
+func TestWebhookBackpressureAdmits(t *testing.T) {
+	webhookTestLimits(t)
+	var inFlight int64
+	var body string
+	r := webhookTestRouter(func(c *gin.Context) {
+		inFlight = atomic.LoadInt64(&webhookBytes)
+		data, _ := ioutil.ReadAll(c.Request.Body)
+		body = string(data)
+		c.Status(http.StatusOK)
+	})
+
+	w := postWebhook(r, "[]", 2)
+	if w.Code != http.StatusOK || body != "[]" {
+		t.Errorf("status %d, body %q; want 200 and the posted body", w.Code, body)
+	}
+	if inFlight != 2 {
+		t.Errorf("%d bytes in flight while handling, want the 2 of the body", inFlight)
+	}
+	assertWebhookIdle(t)
+
+	w = postWebhook(r, "[]", -1)
+	if w.Code != http.StatusOK || inFlight != 100 {
+		t.Errorf("unknown length: status %d, %d bytes in flight; want 200 and WEBHOOK_MAX_BODY_BYTES", w.Code, inFlight)
+	}
+	assertWebhookIdle(t)
+}
+
+func TestWebhookBackpressureCutsUnknownLength(t *testing.T) {
+	webhookTestLimits(t)
+	var readErr error
+	r := webhookTestRouter(func(c *gin.Context) {
+		_, readErr = ioutil.ReadAll(c.Request.Body)
+		c.Status(http.StatusOK)
+	})
+	postWebhook(r, strings.Repeat("x", 101), -1)
+	if readErr == nil {
+		t.Error("a body of unknown length was read past WEBHOOK_MAX_BODY_BYTES")
+	}
+	assertWebhookIdle(t)
+}
+
+func TestWebhookBackpressureReleasesOnEarlyReturn(t *testing.T) {
+	webhookTestLimits(t)
+	r := webhookTestRouter(func(c *gin.Context) {
+		c.AbortWithStatus(http.StatusBadRequest) // without reading the body
+	})
+	for i := 0; i < 3; i++ {
+		if w := postWebhook(r, strings.Repeat("x", 80), 80); w.Code != http.StatusBadRequest {
+			t.Fatalf("request %d: status %d, want 400 from the handler", i, w.Code)
+		}
+	}
+	assertWebhookIdle(t)
+}
+
+func TestWebhookBackpressureSheds(t *testing.T) {
+	tests := []struct {
+		name       string
+		hold       []string // bodies of requests kept in their handler meanwhile
+		queued     int64
+		body       string
+		length     int64
+		status     int
+		reason     string
+		retryAfter string
+	}{
+		{name: "too large", body: strings.Repeat("x", 101), length: 101, status: http.StatusRequestEntityTooLarge, reason: shedTooLarge},
+		{name: "backlog", queued: 3, body: "[]", length: 2, status: http.StatusServiceUnavailable, reason: shedBacklog, retryAfter: "30"},
+		{name: "bytes", hold: []string{strings.Repeat("x", 100)}, body: strings.Repeat("x", 51), length: 51, status: http.StatusTooManyRequests, reason: shedBytes, retryAfter: "30"},
+		{name: "busy", hold: []string{"[]", "[]"}, body: "[]", length: 2, status: http.StatusServiceUnavailable, reason: shedBusy, retryAfter: "30"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			webhookTestLimits(t)
+			atomic.StoreInt64(&queuedEvents, tt.queued)
+			var releases []func()
+			for _, body := range tt.hold {
+				releases = append(releases, holdWebhook(t, body))
+			}
+			shed := webhookShed[tt.reason].Count()
+
+			handled := false
+			w := postWebhook(webhookTestRouter(func(c *gin.Context) { handled = true }), tt.body, tt.length)
+			if w.Code != tt.status || handled {
+				t.Errorf("status %d, handled %v; want %d, not handled", w.Code, handled, tt.status)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.retryAfter {
+				t.Errorf("Retry-After %q, want %q", got, tt.retryAfter)
+			}
+			if !strings.Contains(w.Body.String(), `"reason":"`+tt.reason+`"`) {
+				t.Errorf("body %s, want reason %s", w.Body.String(), tt.reason)
+			}
+			if n := webhookShed[tt.reason].Count() - shed; n != 1 {
+				t.Errorf("shed counter %s went up by %d, want 1", tt.reason, n)
+			}
+
+			for _, release := range releases {
+				release()
+			}
+			assertWebhookIdle(t)
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/MakeNowJust/heredoc"
+)
+
+// CategorySearchIds matches active categories and sub-categories whose
+// name, or system_name for the English slugs, has a word starting with
+// term, leaving out adults-only ones
+// and those without a searchable product. Sub-category ids are negated so
+// both kinds fit one id list; the busiest come first.
+func CategorySearchIds(ctx context.Context, unsanitizedTerm string, limit int) (total int, ids []int) {
+	term := strings.ToLower(strings.TrimSpace(likeEscape(slugWords.Replace(sanitize(unsanitizedTerm)))))
+	if term == "" {
+		return
+	}
+	request := heredoc.Docf(`
+		WITH matched AS (
+			%s
+		)
+		SELECT id, (SELECT COUNT(1) FROM matched) AS total
+		FROM matched
+		ORDER BY products DESC, id
+		%s
+	`, categoryMatchesSQL(ctx, func(name, systemName string) string {
+		words := func(column string) string {
+			return fmt.Sprintf(`' ' || replace(replace(lower(%s), '-', ' '), '_', ' ')`, column)
+		}
+		return fmt.Sprintf(`AND (%s LIKE '%% %s%%' OR %s LIKE '%% %s%%')`, words(name), term, words(systemName), term)
+	}), limitClause(limit))
+
+	type Results struct {
+		Id    int `db:"id"`
+		Total int `db:"total"`
+	}
+	results := []Results{}
+	if err := selectContext(ctx, searchDB, opSearch, &results, request); err != nil {
+		fmt.Println("category search error:", err)
+		return
+	}
+	for _, r := range results {
+		total = r.Total
+		ids = append(ids, r.Id)
+	}
+	return
+}
+
+// filterCategories hydrates CategorySearchIds results. Title is the name,
+// or the system_name made readable when there is none, and Parent the
+// category of a sub-category.
+func filterCategories(ctx context.Context, ids []int) (result SearchSuggestions) {
+	result = SearchSuggestions{}
+	if len(ids) == 0 {
+		return
+	}
+	var order []string
+	for i, id := range ids {
+		order = append(order, fmt.Sprintf("(%d,%d)", id, i))
+	}
+	request := heredoc.Docf(`
+		WITH matched AS (
+			%s
+		)
+		SELECT matched.id, COALESCE(NULLIF(matched.name, ''), initcap(replace(matched.system_name, '-', ' '))) title,
+			matched.system_name, matched.parent, matched.products
+		FROM matched
+		JOIN (values %s) AS x(id, ordering) ON matched.id = x.id
+		ORDER BY x.ordering
+	`, categoryMatchesSQL(ctx, func(string, string) string {
+		return fmt.Sprintf("AND id IN (%s)", strings.Join(absIds(ids), ","))
+	}), strings.Join(order, ","))
+
+	if err := selectContext(ctx, searchDB, opHydrate, &result, request); err != nil {
+		fmt.Println("category hydration error:", err)
+		result = SearchSuggestions{}
+	}
+	return
+}
+
+// categoryMatchesSQL selects id, name, system_name, parent and products of
+// the categories and sub-categories passing cond, which is given the
+// qualified name and system_name columns. Products are counted while valid
+// at the search time.
+func categoryMatchesSQL(ctx context.Context, cond func(name, systemName string) string) string {
+	now := timestampSQL(searchTime(ctx))
+	adultCategories, adultSubCategories, _ := adultsOnlyCategories()
+	adultCategories = append(adultCategories, 0)
+	adultSubCategories = append(adultSubCategories, 0)
+
+	return heredoc.Docf(`
+		WITH valid_products AS (
+			SELECT psc.sub_category_id, 'p' || psc.product_id AS product
+			FROM products_sub_categories psc
+			JOIN products ON products.id = psc.product_id
+			WHERE products.ready = 't' AND products.visible = 't' AND %s BETWEEN products.valid_from AND products.valid_until
+			UNION ALL
+			SELECT spsc.sub_category_id, 's' || spsc.product_id
+			FROM shop_products_sub_categories spsc
+			JOIN shop_products ON shop_products.id = spsc.product_id
+			JOIN shop_sales ON shop_sales.id = shop_products.sale_id
+			WHERE shop_sales.hidden = 'f' AND shop_sales.status = 'READY' AND shop_products.delivery_product = false
+				AND %s BETWEEN shop_sales.start_date AND shop_sales.end_date
+		),
+		candidates AS (
+			SELECT categories.id, categories.name, categories.system_name, '' AS parent,
+				(SELECT COUNT(DISTINCT vp.product) FROM valid_products vp
+					JOIN categories_sub_categories csc ON csc.sub_category_id = vp.sub_category_id
+					WHERE csc.category_id = categories.id) AS products
+			FROM categories
+			WHERE categories.is_active = true AND categories.id NOT IN (%s) %s
+			UNION ALL
+			SELECT -sub_categories.id, sub_categories.name, sub_categories.system_name,
+				(SELECT categories.system_name FROM categories_sub_categories csc
+					JOIN categories ON categories.id = csc.category_id AND categories.is_active = true
+					WHERE csc.sub_category_id = sub_categories.id
+					ORDER BY csc.priority LIMIT 1),
+				(SELECT COUNT(DISTINCT vp.product) FROM valid_products vp WHERE vp.sub_category_id = sub_categories.id)
+			FROM sub_categories
+			WHERE sub_categories.id NOT IN (%s) %s
+		)
+		SELECT * FROM candidates WHERE products > 0 AND parent IS NOT NULL
+	`, now, now, arrayToString(adultCategories, ","), cond("categories.name", "categories.system_name"),
+		arrayToString(adultSubCategories, ","), cond("sub_categories.name", "sub_categories.system_name"))
+}
+
+func absIds(ids []int) (result []string) {
+	for _, id := range ids {
+		if id < 0 {
+			id = -id
+		}
+		result = append(result, strconv.Itoa(id))
+	}
+	return
+}
+
+// slugWords splits system_name slugs into words.
+var slugWords = strings.NewReplacer("-", " ", "_", " ")
+
+// likeEscape protects the LIKE wildcards in term.
+func likeEscape(term string) string {
+	return strings.NewReplacer("%", `\%`, "_", `\_`).Replace(term)
+}
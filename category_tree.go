@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MakeNowJust/heredoc"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+const (
+	categoryTreeRefreshInterval = 10 * time.Minute
+	categoryTreeNotifyChannel   = "category_tree_changed"
+	adultsOnlySystemName        = "adults-only"
+)
+
+// Category is a node of the categories table. Ancestry is the slash
+// separated list of ancestor ids, root first, as the ancestry gem keeps it.
+type Category struct {
+	ID         int    `db:"id"`
+	SystemName string `db:"system_name"`
+	Ancestry   string `db:"ancestry"`
+	IsActive   bool   `db:"is_active"`
+
+	parent        *Category
+	children      []*Category
+	subCategories []*SubCategory
+}
+
+type SubCategory struct {
+	ID         int    `db:"id" json:"id"`
+	SystemName string `db:"system_name" json:"system_name"`
+}
+
+// CategoryTree is categories, sub_categories and categories_sub_categories
+// held in memory, so walking the ancestry needs no query.
+type CategoryTree struct {
+	roots         []*Category
+	categories    map[int]*Category
+	bySystemName  map[string]*Category
+	subCategories map[int]*SubCategory
+}
+
+var (
+	categoryTreeMu sync.RWMutex
+	categoryTree   *CategoryTree
+)
+
+func currentCategoryTree() *CategoryTree {
+	categoryTreeMu.RLock()
+	defer categoryTreeMu.RUnlock()
+	return categoryTree
+}
+
+// prepareCategoryTree loads the tree and keeps it fresh: at once on a
+// category_tree_changed notification, when the triggers sending it are in
+// place, every ten minutes regardless.
+func prepareCategoryTree() {
+	refreshCategoryTree()
+
+	var notifications <-chan *pq.Notification
+	if hasNotifyTriggers("notify_category_tree_changed", categoryTreeNotifyChannel) {
+		listener := pq.NewListener(config.DatabaseURL, time.Second, time.Minute, nil)
+		if err := listener.Listen(categoryTreeNotifyChannel); err != nil {
+			fmt.Println("Unable to listen for category changes:", err)
+		} else {
+			notifications = listener.NotificationChannel()
+		}
+	}
+
+	go func() {
+		refresh := time.NewTicker(categoryTreeRefreshInterval)
+		for {
+			select {
+			case <-refresh.C:
+			case <-notifications:
+			}
+			refreshCategoryTree()
+		}
+	}()
+}
+
+func refreshCategoryTree() {
+	tree, err := loadCategoryTree()
+	if err != nil {
+		fmt.Println("Unable to load the category tree:", err)
+		return
+	}
+	categoryTreeMu.Lock()
+	categoryTree = tree
+	categoryTreeMu.Unlock()
+}
+
+func loadCategoryTree() (tree *CategoryTree, err error) {
+	categories := []*Category{}
+	request := `SELECT id, COALESCE(system_name, '') system_name, COALESCE(ancestry, '') ancestry, is_active FROM categories ORDER BY id`
+	if err = dbx.Select(&categories, request); err != nil {
+		return
+	}
+	subCategories := []*SubCategory{}
+	if err = dbx.Select(&subCategories, `SELECT id, COALESCE(system_name, '') system_name FROM sub_categories ORDER BY id`); err != nil {
+		return
+	}
+	type Link struct {
+		CategoryID    int `db:"category_id"`
+		SubCategoryID int `db:"sub_category_id"`
+	}
+	links := []Link{}
+	request = heredoc.Doc(`
+		SELECT category_id, sub_category_id
+		FROM categories_sub_categories
+		ORDER BY category_id, priority
+	`)
+	if err = dbx.Select(&links, request); err != nil {
+		return
+	}
+
+	tree = &CategoryTree{
+		categories:    make(map[int]*Category, len(categories)),
+		bySystemName:  make(map[string]*Category, len(categories)),
+		subCategories: make(map[int]*SubCategory, len(subCategories)),
+	}
+	for _, c := range categories {
+		tree.categories[c.ID] = c
+		tree.bySystemName[c.SystemName] = c
+	}
+	for _, c := range categories {
+		if c.parent = tree.categories[parentID(c.Ancestry)]; c.parent != nil {
+			c.parent.children = append(c.parent.children, c)
+		} else {
+			tree.roots = append(tree.roots, c)
+		}
+	}
+	for _, s := range subCategories {
+		tree.subCategories[s.ID] = s
+	}
+	for _, l := range links {
+		if c, s := tree.categories[l.CategoryID], tree.subCategories[l.SubCategoryID]; c != nil && s != nil {
+			c.subCategories = append(c.subCategories, s)
+		}
+	}
+	return tree, nil
+}
+
+// parentID is the last id of an ancestry string, 0 for a root.
+func parentID(ancestry string) int {
+	id, _ := strconv.Atoi(ancestry[strings.LastIndex(ancestry, "/")+1:])
+	return id
+}
+
+// Category looks a category up by id or, failing that, by system_name.
+func (t *CategoryTree) Category(key string) *Category {
+	if id, err := strconv.Atoi(key); err == nil {
+		return t.categories[id]
+	}
+	return t.bySystemName[key]
+}
+
+// Ancestors lists the ancestors of c, root first.
+func (t *CategoryTree) Ancestors(c *Category) (ancestors []*Category) {
+	for p := c.parent; p != nil; p = p.parent {
+		ancestors = append([]*Category{p}, ancestors...)
+	}
+	return
+}
+
+// Path is the ancestors of c followed by c itself.
+func (t *CategoryTree) Path(c *Category) []*Category {
+	return append(t.Ancestors(c), c)
+}
+
+// Descendants lists everything below c, depth first.
+func (t *CategoryTree) Descendants(c *Category) (descendants []*Category) {
+	for _, child := range c.children {
+		descendants = append(descendants, child)
+		descendants = append(descendants, t.Descendants(child)...)
+	}
+	return
+}
+
+// subtreeIds lists id and the ids of every category below it, just id while
+// the tree is not loaded or does not know it yet.
+func subtreeIds(id int) []int {
+	ids := []int{id}
+	tree := currentCategoryTree()
+	if tree == nil || tree.categories[id] == nil {
+		return ids
+	}
+	for _, c := range tree.Descendants(tree.categories[id]) {
+		ids = append(ids, c.ID)
+	}
+	return ids
+}
+
+// SubCategoryIds lists the sub-categories attached to any of categories.
+func (t *CategoryTree) SubCategoryIds(categories []*Category) (ids []int) {
+	seen := map[int]bool{}
+	for _, c := range categories {
+		for _, s := range c.subCategories {
+			if !seen[s.ID] {
+				seen[s.ID] = true
+				ids = append(ids, s.ID)
+			}
+		}
+	}
+	sort.Ints(ids)
+	return
+}
+
+// CategoryNode is a category as served by GET /api/categories/tree.
+type CategoryNode struct {
+	ID            int            `json:"id"`
+	SystemName    string         `json:"system_name"`
+	SubCategories []*SubCategory `json:"sub_categories"`
+	Children      []CategoryNode `json:"children"`
+}
+
+// node renders c and its active descendants.
+func (t *CategoryTree) node(c *Category) CategoryNode {
+	n := CategoryNode{ID: c.ID, SystemName: c.SystemName, SubCategories: c.subCategories, Children: []CategoryNode{}}
+	if n.SubCategories == nil {
+		n.SubCategories = []*SubCategory{}
+	}
+	for _, child := range c.children {
+		if child.IsActive {
+			n.Children = append(n.Children, t.node(child))
+		}
+	}
+	return n
+}
+
+// getCategoryTree serves the active category tree, or with ?category= (an
+// id or system_name) that category's subtree and its path from the root.
+func getCategoryTree(c *gin.Context) {
+	tree := currentCategoryTree()
+	if tree == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "category tree not loaded"})
+		return
+	}
+
+	key := c.Query("category")
+	if key == "" {
+		roots := []CategoryNode{}
+		for _, r := range tree.roots {
+			if r.IsActive {
+				roots = append(roots, tree.node(r))
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"categories": roots})
+		return
+	}
+
+	category := tree.Category(key)
+	if category == nil || !category.IsActive {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown category"})
+		return
+	}
+	path := []gin.H{}
+	for _, p := range tree.Path(category) {
+		path = append(path, gin.H{"id": p.ID, "system_name": p.SystemName})
+	}
+	c.JSON(http.StatusOK, gin.H{"category": tree.node(category), "path": path})
+}
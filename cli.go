@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// What a command needs prepared before it runs; each level includes the
+// ones before it. The configuration is always loaded.
+const (
+	needsConfig = iota // validated configuration
+	needsDB            // the connection pools
+	needsSearch        // verticals, clock, category tree, synonyms
+)
+
+type command struct {
+	name    string
+	usage   string
+	summary string
+	needs   int
+	run     func(w io.Writer, args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "serve", "serve the HTTP API (the default)", needsDB, runServe},
+		{"work", "work", "register queued events and run the periodic jobs, without HTTP", needsDB, runWork},
+		{"migrate", "migrate up|down [steps]|status", "apply, revert or list schema migrations", needsDB, runMigrate},
+		{"replay", "replay [-format auto|json|csv] [-rate n] [-dry-run] [-progress d] <file>", "register archived SendGrid events as if posted", needsDB, runReplay},
+		{"export", "export [-since t] [-until t] [-event type] [-format ndjson|csv]", "dump recorded events", needsDB, runExport},
+		{"dlq", "dlq list [-limit n] | retry (-all | id...) | discard id...", "inspect and retry dead letters", needsDB, runDLQ},
+		{"search", "search [-verticals a,b] [-at t] [-autocorrect] <term>", "print the suggestions for term", needsSearch, runSearch},
+		{"evaluate-ranking", "evaluate-ranking <queries.yml>", "compare NDCG of text-only and weighted ranking", needsSearch, runEvaluateRanking},
+		{"config", "config print", "print the effective configuration", needsConfig, runConfig},
+		{"help", "help", "list the commands", needsConfig, runHelp},
+	}
+}
+
+// runCLI runs the command named by args[0], serve when there is none, and
+// returns the process exit status.
+func runCLI(args []string) int {
+	name := "serve"
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == name {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		usage(os.Stderr)
+		return 2
+	}
+
+	var configErr error
+	if config, configErr = loadConfig(); configErr != nil {
+		log.Fatalf("Configuration error: %v\n", configErr)
+	}
+	if cmd.name != "config" && cmd.name != "help" {
+		if configErr = config.validate(); configErr != nil {
+			log.Fatalf("%v\n", configErr)
+		}
+	}
+	if cmd.needs >= needsDB {
+		prepareDB()
+		defer closeDB()
+	}
+	if cmd.needs >= needsSearch {
+		prepareSearch()
+		refreshCategoryTree()
+		loadSynonyms()
+		loadRanking()
+	}
+
+	if err := cmd.run(os.Stdout, args); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", cmd.name, err)
+		return 1
+	}
+	return 0
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "usage: %s <command> [arguments]\n\n", filepath.Base(os.Args[0]))
+	width := 0
+	for _, cmd := range commands {
+		width = max(width, len(cmd.usage))
+	}
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-*s  %s\n", width, cmd.usage, cmd.summary)
+	}
+}
+
+func runHelp(w io.Writer, args []string) error {
+	usage(w)
+	return nil
+}
+
+// runConfig prints the configuration even when it is invalid, then fails
+// with the problems.
+func runConfig(w io.Writer, args []string) error {
+	if len(args) != 1 || args[0] != "print" {
+		return fmt.Errorf("usage: config print")
+	}
+	config.print(w)
+	return config.validate()
+}
+
+func runEvaluateRanking(w io.Writer, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: evaluate-ranking <queries.yml>")
+	}
+	return evaluateRanking(w, args[0])
+}
+
+// runSearch prints what /search/search_suggestions would answer for a
+// term, straight from Postgres, without caching or analytics.
+func runSearch(w io.Writer, args []string) error {
+	flags := flag.NewFlagSet("search", flag.ContinueOnError)
+	names := flags.String("verticals", "", "comma separated verticals, all when empty")
+	at := flags.String("at", "", "search as of this business time, RFC 3339 or YYYY-MM-DD[THH:MM[:SS]]")
+	autocorrect := flags.Bool("autocorrect", false, "show the results of the best correction when nothing matches")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	term := strings.Join(flags.Args(), " ")
+	if strings.TrimSpace(term) == "" {
+		return fmt.Errorf("usage: search [-verticals a,b] [-at t] [-autocorrect] <term>")
+	}
+
+	ctx := context.Background()
+	if *at != "" {
+		t, err := parsePreviewTime(*at)
+		if err != nil {
+			return err
+		}
+		ctx = withSearchTime(ctx, t)
+	}
+	loadVocabulary()
+
+	response := computeSuggestions(ctx, normalizeTerm(term), verticals.Select(*names), *autocorrect)
+	if response == nil {
+		return fmt.Errorf("unable to render suggestions")
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, response.Body, "", "  "); err != nil {
+		return err
+	}
+	out.WriteString("\n")
+	_, err := out.WriteTo(w)
+	return err
+}
+
+// runWork is the worker process: more of them register queued events
+// faster, whatever the number of web instances.
+func runWork(w io.Writer, args []string) error {
+	if config.Events.Workers == 0 {
+		return fmt.Errorf("EVENT_WORKERS is 0, nothing to do")
+	}
+	startEventWorkers(config.Events.Workers)
+	startSingletonJobs()
+	fmt.Fprintln(w, "WORKING with", config.Events.Workers, "event workers")
+	select {}
+}
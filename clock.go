@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+	_ "time/tzdata" // BUSINESS_TIMEZONE must not depend on the host's zoneinfo
+
+	"github.com/gin-gonic/gin"
+)
+
+// businessLocation is the timezone validity windows (valid_from/valid_until,
+// start_date/end_date) are written in. Those columns have no time zone, so
+// "now" has to be read off the business clock rather than the database's.
+var businessLocation = time.Local
+
+// previewFormats are the accepted forms of the at= parameter besides
+// RFC 3339, all read in the business timezone.
+var previewFormats = []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+type searchTimeKey struct{}
+
+// prepareClock applies the business_timezone setting, an IANA name such as
+// Asia/Jerusalem; the server's own timezone is used without it.
+func prepareClock() {
+	if tz := config.BusinessTimezone; tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			log.Fatalf("Bad BUSINESS_TIMEZONE: %v\n", err)
+		}
+		businessLocation = loc
+	}
+}
+
+// localTimestamp is the business wall clock, labelled UTC the way timestamp
+// without time zone columns are scanned.
+func localTimestamp() time.Time {
+	return wallClock(time.Now())
+}
+
+func wallClock(t time.Time) time.Time {
+	t = t.In(businessLocation)
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// withSearchTime makes searches under ctx evaluate validity at the given
+// wall clock instead of now.
+func withSearchTime(ctx context.Context, at time.Time) context.Context {
+	return context.WithValue(ctx, searchTimeKey{}, at)
+}
+
+// searchTime is the instant validity windows are evaluated at under ctx.
+func searchTime(ctx context.Context) time.Time {
+	if at, ok := isPreview(ctx); ok {
+		return at
+	}
+	return localTimestamp()
+}
+
+func isPreview(ctx context.Context) (at time.Time, ok bool) {
+	at, ok = ctx.Value(searchTimeKey{}).(time.Time)
+	return
+}
+
+// timestampSQL is t as a timestamp without time zone literal.
+func timestampSQL(t time.Time) string {
+	return fmt.Sprintf("'%s'::timestamp", t.Format("2006-01-02 15:04:05.999999"))
+}
+
+// searchContext is the request context, moved to the at= instant when an
+// admin asks for a preview. It answers the request itself and returns
+// ok=false when at= is refused.
+func searchContext(c *gin.Context) (ctx context.Context, ok bool) {
+	ctx = c.Request.Context()
+	s := c.Query("at")
+	if s == "" {
+		return ctx, true
+	}
+	if !isAdmin(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "at= requires an admin token"})
+		return
+	}
+	at, err := parsePreviewTime(s)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	return withSearchTime(ctx, at), true
+}
+
+func parsePreviewTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return wallClock(t), nil
+	}
+	for _, layout := range previewFormats {
+		if t, err := time.ParseInLocation(layout, s, businessLocation); err == nil {
+			return wallClock(t), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("bad at %q, want RFC 3339 or YYYY-MM-DD[THH:MM[:SS]]", s)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MakeNowJust/heredoc"
+)
+
+// DeadLetter is an event the writer failed to register.
+type DeadLetter struct {
+	ID        int64     `db:"id"`
+	Payload   string    `db:"payload"`
+	Error     string    `db:"error"`
+	Attempts  int       `db:"attempts"`
+	CreatedAt time.Time `db:"created_at"`
+	FailedAt  time.Time `db:"failed_at"`
+}
+
+// deadLetter keeps event and why it failed for a later "dlq retry".
+func deadLetter(ctx context.Context, event Event, cause error) {
+	request := `INSERT INTO email_dead_letters (payload, error) VALUES ($1, $2)`
+	if _, err := execContext(ctx, dbx, opEvents, request, string(event.payload()), cause.Error()); err != nil {
+		fmt.Printf("Unable to dead-letter %s event for %s: %v\n", event.Event, event.Email, err)
+	}
+}
+
+func loadDeadLetters(ids []int64, limit int) (letters []DeadLetter, err error) {
+	letters = []DeadLetter{}
+	where := ""
+	if ids != nil {
+		var list []string
+		for _, id := range ids {
+			list = append(list, strconv.FormatInt(id, 10))
+		}
+		where = fmt.Sprintf("WHERE id IN (%s)", strings.Join(append(list, "0"), ","))
+	}
+	request := heredoc.Docf(`
+		SELECT id, payload, error, attempts, created_at, failed_at
+		FROM email_dead_letters
+		%s
+		ORDER BY id
+		%s
+	`, where, limitClause(limit))
+	err = dbx.Select(&letters, request)
+	return
+}
+
+// retryDeadLetter writes the event again: gone from the dead letters when
+// it goes through, its attempt counted otherwise.
+func retryDeadLetter(ctx context.Context, letter DeadLetter) error {
+	event, err := decodeEvent([]byte(letter.Payload))
+	if err == nil {
+		err = event.validate()
+	}
+	if err == nil {
+		_, err = writeEvent(ctx, event)
+	}
+	if err != nil {
+		request := `UPDATE email_dead_letters SET attempts = attempts + 1, error = $2, failed_at = now() WHERE id = $1`
+		if _, updateErr := execContext(ctx, dbx, opEvents, request, letter.ID, err.Error()); updateErr != nil {
+			fmt.Printf("Unable to record retry of dead letter %d: %v\n", letter.ID, updateErr)
+		}
+		return err
+	}
+	_, err = execContext(ctx, dbx, opEvents, `DELETE FROM email_dead_letters WHERE id = $1`, letter.ID)
+	return err
+}
+
+// runDLQ handles "dlq list", "dlq retry" and "dlq discard".
+func runDLQ(w io.Writer, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: dlq list [-limit n] | retry (-all | id...) | discard id...")
+	}
+	flags := flag.NewFlagSet("dlq "+args[0], flag.ContinueOnError)
+	limit := flags.Int("limit", 50, "dead letters to list, 0 for all")
+	all := flags.Bool("all", false, "retry every dead letter")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	var ids []int64
+	for _, arg := range flags.Args() {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return fmt.Errorf("dlq %s: %q is not a dead letter id", args[0], arg)
+		}
+		ids = append(ids, id)
+	}
+
+	ctx := context.Background()
+	switch args[0] {
+	case "list":
+		letters, err := loadDeadLetters(nil, *limit)
+		if err != nil {
+			return err
+		}
+		for _, l := range letters {
+			fmt.Fprintf(w, "%d\t%s\t%d attempt(s)\t%s\n\t%s\n",
+				l.ID, l.FailedAt.Format("2006-01-02 15:04:05"), l.Attempts, l.Error, l.Payload)
+		}
+		fmt.Fprintf(w, "%d dead letter(s)\n", len(letters))
+		return nil
+
+	case "retry":
+		if ids == nil && !*all {
+			return fmt.Errorf("dlq retry: give ids or -all")
+		}
+		letters, err := loadDeadLetters(ids, 0)
+		if err != nil {
+			return err
+		}
+		failed := 0
+		for _, l := range letters {
+			if err := retryDeadLetter(ctx, l); err != nil {
+				failed++
+				fmt.Fprintf(w, "%d failed again: %v\n", l.ID, err)
+			}
+		}
+		fmt.Fprintf(w, "retried %d, %d failed\n", len(letters), failed)
+		if failed > 0 {
+			return fmt.Errorf("%d dead letter(s) still failing", failed)
+		}
+		return nil
+
+	case "discard":
+		if ids == nil {
+			return fmt.Errorf("dlq discard: give the ids to discard")
+		}
+		letters, err := loadDeadLetters(ids, 0)
+		if err != nil {
+			return err
+		}
+		for _, l := range letters {
+			if _, err := execContext(ctx, dbx, opEvents, `DELETE FROM email_dead_letters WHERE id = $1`, l.ID); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(w, "discarded %d\n", len(letters))
+		return nil
+	}
+	return fmt.Errorf("dlq: unknown command %q, want list, retry or discard", args[0])
+}
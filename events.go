@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/MakeNowJust/heredoc"
+)
+
+// suppressingEvents are the SendGrid events after which an address gets no
+// more mail.
+var suppressingEvents = map[string]bool{
+	"bounce":      true,
+	"dropped":     true,
+	"spamreport":  true,
+	"unsubscribe": true,
+}
+
+// decodeEvents reads a batch as SendGrid posts it, a JSON array of events,
+// keeping each event's original JSON for the history.
+func decodeEvents(data []byte) (events Events, err error) {
+	var raws []json.RawMessage
+	if err = json.Unmarshal(data, &raws); err != nil {
+		return
+	}
+	for i, raw := range raws {
+		event, err := decodeEvent(raw)
+		if err != nil {
+			return nil, fmt.Errorf("event %d: %v", i, err)
+		}
+		events = append(events, event)
+	}
+	return
+}
+
+func decodeEvent(raw []byte) (event Event, err error) {
+	if err = json.Unmarshal(raw, &event); err != nil {
+		return
+	}
+	event.raw = append(json.RawMessage(nil), bytes.TrimSpace(raw)...)
+	return
+}
+
+// validate rejects the events the writer cannot place.
+func (e Event) validate() error {
+	if e.Email == "" {
+		return fmt.Errorf("%s event without an email", e.Event)
+	}
+	if e.Timestamp == 0 {
+		return fmt.Errorf("%s event for %s without a timestamp", e.Event, e.Email)
+	}
+	return nil
+}
+
+func (e Event) payload() json.RawMessage {
+	if e.raw != nil {
+		return e.raw
+	}
+	raw, _ := json.Marshal(e)
+	return raw
+}
+
+// ingestOutcome is what became of an event handed to ingestEvent.
+type ingestOutcome int
+
+const (
+	ingestWritten ingestOutcome = iota
+	ingestDuplicate
+	ingestInvalid
+	ingestFailed
+)
+
+// ingestEvent is the path of replayed events: validated, written, and
+// dead-lettered when the write fails, timeouts included. Posted events go
+// through event_jobs instead, retried before being dead-lettered.
+func ingestEvent(ctx context.Context, event Event) (ingestOutcome, error) {
+	if err := event.validate(); err != nil {
+		return ingestInvalid, err
+	}
+	written, err := writeEvent(ctx, event)
+	if err != nil {
+		deadLetter(ctx, event, err)
+		return ingestFailed, err
+	}
+	if !written {
+		return ingestDuplicate, nil
+	}
+	return ingestWritten, nil
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a character,
+// which Postgres would reject as invalid UTF-8.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// writeEvent records event in email_events and, the first time it is
+// seen, applies it: opens and clicks to the subscription, bounces and the
+// like to email_suppressions. A redelivered event (same sg_event_id) is
+// reported as not written. opened_at and clicked_at only move forward, so
+// events arriving late or replayed never overwrite newer ones.
+func writeEvent(ctx context.Context, event Event) (written bool, err error) {
+	occurredAt := time.Unix(event.Timestamp, 0).UTC()
+	var apply string
+	args := []interface{}{event.SgEventId, event.SgMessageId, event.Event, event.Email, event.Category, event.Url, occurredAt, string(event.payload())}
+	switch {
+	case event.Event == "open":
+		apply = heredoc.Doc(`
+			UPDATE email_subscriptions SET opened_at = $7
+			WHERE email = $4 AND (opened_at IS NULL OR opened_at < $7) AND EXISTS (SELECT 1 FROM recorded)
+		`)
+	case event.Event == "click":
+		apply = heredoc.Doc(`
+			UPDATE email_subscriptions SET (clicked_at, last_clicked_url) = ($7, $9)
+			WHERE email = $4 AND (clicked_at IS NULL OR clicked_at < $7) AND EXISTS (SELECT 1 FROM recorded)
+		`)
+		args = append(args, truncateUTF8(event.Url, 255))
+	case suppressingEvents[event.Event]:
+		apply = heredoc.Doc(`
+			INSERT INTO email_suppressions (email, reason)
+			SELECT $4, $3 WHERE EXISTS (SELECT 1 FROM recorded)
+			ON CONFLICT (email) DO NOTHING
+		`)
+	default:
+		apply = `SELECT 1 FROM recorded`
+	}
+
+	request := heredoc.Docf(`
+		WITH recorded AS (
+			INSERT INTO email_events (sg_event_id, sg_message_id, event, email, category, url, happened_at, payload)
+			VALUES (NULLIF($1, ''), $2, $3, $4, $5, $6, $7, $8)
+			ON CONFLICT (sg_event_id) DO NOTHING
+			RETURNING id
+		), applied AS (
+			%s
+		)
+		SELECT COUNT(1) FROM recorded
+	`, apply)
+	var recorded int
+	err = withQueryContext(ctx, dbx, opEvents, func(ctx context.Context, conn *sql.Conn) error {
+		return conn.QueryRowContext(ctx, request, args...).Scan(&recorded)
+	})
+	return recorded > 0, err
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateUTF8(t *testing.T) {
+	long := "https://example.com/" + strings.Repeat("a", 234) // 254 bytes
+	tests := []struct {
+		in, want string
+	}{
+		{"https://example.com/", "https://example.com/"},
+		{long + "b", long + "b"},
+		{long + "bc", long + "b"},
+		{long + "é", long},        // é takes bytes 255 and 256
+		{long + "b€", long + "b"}, // € starts at byte 256
+		{long[:253] + "€", long[:253]},
+	}
+	for _, tt := range tests {
+		got := truncateUTF8(tt.in, 255)
+		if got != tt.want || !utf8.ValidString(got) || len(got) > 255 {
+			t.Errorf("truncateUTF8(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/MakeNowJust/heredoc"
+)
+
+var exportColumns = []string{"sg_event_id", "sg_message_id", "event", "email", "category", "url", "happened_at"}
+
+// runExport dumps email_events, oldest first: as NDJSON of the payloads
+// SendGrid sent, which "replay" reads back, or as CSV.
+func runExport(w io.Writer, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	since := flags.String("since", "", "only events that happened at or after, UTC `YYYY-MM-DD` or RFC 3339")
+	until := flags.String("until", "", "only events that happened before, UTC `YYYY-MM-DD` or RFC 3339")
+	kind := flags.String("event", "", "only this event type, e.g. open or click")
+	format := flags.String("format", "ndjson", "ndjson or csv")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *format != "ndjson" && *format != "csv" {
+		return fmt.Errorf("export: unknown -format %q, want ndjson or csv", *format)
+	}
+
+	var (
+		conds  []string
+		params []interface{}
+	)
+	for _, bound := range []struct {
+		value, op string
+	}{{*since, ">="}, {*until, "<"}} {
+		if bound.value == "" {
+			continue
+		}
+		t, err := parseExportTime(bound.value)
+		if err != nil {
+			return err
+		}
+		params = append(params, t)
+		conds = append(conds, fmt.Sprintf("happened_at %s $%d", bound.op, len(params)))
+	}
+	if *kind != "" {
+		params = append(params, *kind)
+		conds = append(conds, fmt.Sprintf("event = $%d", len(params)))
+	}
+	where := ""
+	if len(conds) > 0 {
+		where = "WHERE " + strings.Join(conds, " AND ")
+	}
+
+	request := heredoc.Docf(`
+		SELECT payload, COALESCE(sg_event_id, ''), COALESCE(sg_message_id, ''), event, email,
+			COALESCE(category, ''), COALESCE(url, ''), happened_at
+		FROM email_events
+		%s
+		ORDER BY happened_at, id
+	`, where)
+	rows, err := dbx.Query(request, params...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+	table := csv.NewWriter(out)
+	if *format == "csv" {
+		table.Write(exportColumns)
+	}
+	for rows.Next() {
+		var (
+			payload    string
+			record     = make([]string, len(exportColumns))
+			happenedAt time.Time
+		)
+		if err = rows.Scan(&payload, &record[0], &record[1], &record[2], &record[3], &record[4], &record[5], &happenedAt); err != nil {
+			return err
+		}
+		if *format == "ndjson" {
+			fmt.Fprintln(out, payload)
+			continue
+		}
+		record[6] = happenedAt.Format(time.RFC3339)
+		if err = table.Write(record); err != nil {
+			return err
+		}
+	}
+	table.Flush()
+	if err = table.Error(); err != nil {
+		return err
+	}
+	return rows.Err()
+}
+
+func parseExportTime(s string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("export: bad time %q, want YYYY-MM-DD or RFC 3339", s)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/MakeNowJust/heredoc"
+)
+
+// FuzzyConfig controls the pg_trgm fallback used when prefix matching on
+// the tsv column finds too little, typically because of a typo.
+type FuzzyConfig struct {
+	MinResults int     `yaml:"min_results"` // fall back below this many hits, 0 disables
+	Threshold  float64 `yaml:"threshold"`   // word_similarity cut-off, 0..1
+	Weight     float64 `yaml:"weight"`      // weight of similarity against ts_rank
+}
+
+var defaultFuzzy = FuzzyConfig{MinResults: 3, Threshold: 0.3, Weight: 1}
+
+func (f FuzzyConfig) validate() error {
+	if f.MinResults < 0 {
+		return fmt.Errorf("fuzzy: min_results must not be negative")
+	}
+	if f.Threshold <= 0 || f.Threshold > 1 {
+		return fmt.Errorf("fuzzy: threshold must be in (0, 1]")
+	}
+	if f.Weight < 0 {
+		return fmt.Errorf("fuzzy: weight must not be negative")
+	}
+	return nil
+}
+
+// FuzzyResult is what the trigram fallback found, together with the title
+// word it matched best, for "showing results for".
+type FuzzyResult struct {
+	Total     int
+	Ids       []int
+	Corrected string
+}
+
+// ProductFuzzySearchIds is ProductSearchIds with typo tolerance: titles
+// similar enough to the term match as well, and the similarity is blended
+// into the rank. Requires the pg_trgm extension.
+func ProductFuzzySearchIds(ctx context.Context, unsanitizedTerm string, limit int, where string) (result FuzzyResult) {
+	term := sanitize(unsanitizedTerm)
+	request := heredoc.Docf(`
+		WITH coupons AS (
+			SELECT id, title,
+				ts_rank("products"."tsv", %s, 0) + %s * word_similarity('%s', COALESCE(title, '')) AS pg_search_rank
+			FROM products
+			WHERE ready = 't' AND visible = 't' AND %s BETWEEN valid_from AND valid_until
+				%s
+				AND (tsv @@ %s OR tsv @@ %s OR word_similarity('%s', COALESCE(title, '')) > %s)
+		)
+		SELECT id, (SELECT COUNT(1) FROM coupons) AS total, %s AS corrected
+		FROM coupons
+		ORDER BY pg_search_rank DESC
+		%s
+	`, tsQuery(term), formatFloat(fuzzy.Weight), term, timestampSQL(searchTime(ctx)), whereClause(where),
+		tsQuery(term), tsQueryReversed(term), term, formatFloat(fuzzy.Threshold),
+		closestWordSQL("title", term), limitClause(limit))
+
+	return selectFuzzy(ctx, request)
+}
+
+// ShopProductFuzzySearchIds is the shop counterpart of ProductFuzzySearchIds.
+func ShopProductFuzzySearchIds(ctx context.Context, unsanitizedTerm string, limit int, where string) (result FuzzyResult) {
+	term := sanitize(unsanitizedTerm)
+	finalSaleIds, ok := finalSaleProductIds(ctx)
+	if !ok {
+		return
+	}
+
+	request := heredoc.Docf(`
+		WITH search_products AS (
+			SELECT DISTINCT shop_products.id, shop_products.title,
+				ts_rank("shop_products"."tsv", %s, 0) + ts_rank("shop_products"."tsv", %s, 0) +
+				%s * word_similarity('%s', COALESCE(shop_products.title, '')) AS pg_search_rank
+			FROM shop_products
+			INNER JOIN shop_option_types ON shop_option_types.product_id = shop_products.id
+			INNER JOIN shop_catalogs ON shop_catalogs.option_type_id = shop_option_types.id
+			JOIN shop_sales ON shop_products.sale_id = shop_sales.id
+			WHERE (shop_sales.hidden = 'f' OR shop_products.id IN (%s)) AND shop_sales.status = 'READY' AND
+				%s BETWEEN shop_sales.start_date AND shop_sales.end_date AND shop_products.delivery_product = false
+				%s
+				AND (tsv @@ %s OR tsv @@ %s OR word_similarity('%s', COALESCE(shop_products.title, '')) > %s)
+		)
+		SELECT id, (SELECT COUNT(1) FROM search_products) AS total, %s AS corrected
+		FROM search_products
+		ORDER BY pg_search_rank DESC
+		%s
+	`, tsQuery(term), tsQueryReversed(term), formatFloat(fuzzy.Weight), term,
+		arrayToString(finalSaleIds, ","), timestampSQL(searchTime(ctx)), whereClause(where),
+		tsQuery(term), tsQueryReversed(term), term, formatFloat(fuzzy.Threshold),
+		closestWordSQL("title", term), limitClause(limit))
+
+	return selectFuzzy(ctx, request)
+}
+
+func selectFuzzy(ctx context.Context, request string) (result FuzzyResult) {
+	type Results struct {
+		Id        int    `db:"id"`
+		Total     int    `db:"total"`
+		Corrected string `db:"corrected"`
+	}
+	results := []Results{}
+	if err := selectContext(ctx, searchDB, opSearch, &results, request); err != nil {
+		fmt.Println("fuzzy search error:", err)
+		return
+	}
+	if len(results) == 0 {
+		return
+	}
+	result.Total = results[0].Total
+	result.Corrected = results[0].Corrected
+	for _, r := range results {
+		result.Ids = append(result.Ids, r.Id)
+	}
+	return
+}
+
+// closestWordSQL picks the word of column that is most similar to term.
+func closestWordSQL(column, term string) string {
+	return fmt.Sprintf(`COALESCE((SELECT w FROM regexp_split_to_table(lower(COALESCE(%s, '')), '\s+') w
+			ORDER BY similarity(w, '%s') DESC LIMIT 1), '')`, column, term)
+}
+
+func limitClause(limit int) string {
+	if limit > 0 {
+		return fmt.Sprintf(" LIMIT %d", limit)
+	}
+	return ""
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
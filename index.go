@@ -0,0 +1,652 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/MakeNowJust/heredoc"
+	"github.com/lib/pq"
+)
+
+const (
+	indexRebuildInterval = time.Hour
+	indexPollInterval    = 30 * time.Second
+	indexNotifyChannel   = "search_index_changed"
+)
+
+// SuggestionIndex serves suggestions from memory, one prefix trie per
+// vertical holding what is eligible; validity windows are checked at query
+// time. Postgres serves until the first build and category verticals always.
+type SuggestionIndex struct {
+	mu        sync.RWMutex
+	verticals map[string]*verticalIndex
+	ready     bool
+	now       func() time.Time // the business wall clock validity is checked at
+
+	// newest updated_at seen per table, for polling
+	watermarks map[string]time.Time
+}
+
+type verticalIndex struct {
+	items map[int]*indexedItem
+	root  *trieNode
+}
+
+type indexedItem struct {
+	SearchSuggestion
+	StartsAt time.Time `db:"starts_at"`
+	EndsAt   time.Time `db:"ends_at"`
+	Sold     float64   `db:"sold"`
+
+	words []string
+}
+
+// indexCandidate is a row loadIndexItems reads, with the flags deciding
+// whether it may be suggested at all.
+type indexCandidate struct {
+	SearchSuggestion
+	StartsAt  pq.NullTime `db:"starts_at"`
+	EndsAt    time.Time   `db:"ends_at"`
+	Sold      float64     `db:"sold"`
+	Ready     bool        `db:"ready"` // a ready, visible product or a READY sale
+	Hidden    bool        `db:"hidden"`
+	FinalSale bool        `db:"final_sale"`
+	Delivery  bool        `db:"delivery"`
+}
+
+// eligible tells whether a candidate may be suggested: ready, dated, not
+// a delivery fee, and in a hidden sale only when on final sale.
+func (c *indexCandidate) eligible() bool {
+	return c.Ready && c.StartsAt.Valid && !c.Delivery && (!c.Hidden || c.FinalSale)
+}
+
+// indexItems keeps the eligible candidates.
+func indexItems(candidates []*indexCandidate) (items []*indexedItem) {
+	for _, c := range candidates {
+		if c.eligible() {
+			items = append(items, &indexedItem{SearchSuggestion: c.SearchSuggestion, StartsAt: c.StartsAt.Time, EndsAt: c.EndsAt, Sold: c.Sold})
+		}
+	}
+	return
+}
+
+type trieNode struct {
+	children map[rune]*trieNode
+	ids      map[int]struct{} // items with a word starting with this prefix
+}
+
+// suggestionIndex is nil unless SUGGESTION_INDEX is set.
+var suggestionIndex *SuggestionIndex
+
+func prepareSuggestionIndex() {
+	if !config.SuggestionIndex.Enabled {
+		return
+	}
+	suggestionIndex = newSuggestionIndex(localTimestamp)
+	go suggestionIndex.maintain(config.SuggestionIndex.Listen)
+}
+
+func newSuggestionIndex(now func() time.Time) *SuggestionIndex {
+	return &SuggestionIndex{verticals: map[string]*verticalIndex{}, watermarks: map[string]time.Time{}, now: now}
+}
+
+// Load replaces the items of a vertical and marks the index ready.
+func (idx *SuggestionIndex) Load(vertical string, items []*indexedItem) {
+	vi := newVerticalIndex(items)
+	idx.mu.Lock()
+	idx.verticals[vertical], idx.ready = vi, true
+	idx.mu.Unlock()
+}
+
+func newVerticalIndex(items []*indexedItem) *verticalIndex {
+	vi := &verticalIndex{items: map[int]*indexedItem{}, root: newTrieNode()}
+	for _, item := range items {
+		vi.put(item)
+	}
+	return vi
+}
+
+func newTrieNode() *trieNode {
+	return &trieNode{children: map[rune]*trieNode{}, ids: map[int]struct{}{}}
+}
+
+func (n *trieNode) insert(word string, id int) {
+	for _, ch := range word {
+		child, ok := n.children[ch]
+		if !ok {
+			child = newTrieNode()
+			n.children[ch] = child
+		}
+		child.ids[id] = struct{}{}
+		n = child
+	}
+}
+
+func (n *trieNode) remove(word string, id int) {
+	for _, ch := range word {
+		child, ok := n.children[ch]
+		if !ok {
+			return
+		}
+		delete(child.ids, id)
+		if len(child.ids) == 0 {
+			delete(n.children, ch)
+			return
+		}
+		n = child
+	}
+}
+
+func (n *trieNode) find(prefix string) map[int]struct{} {
+	for _, ch := range prefix {
+		child, ok := n.children[ch]
+		if !ok {
+			return nil
+		}
+		n = child
+	}
+	return n.ids
+}
+
+func tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(ch rune) bool {
+		return !unicode.IsLetter(ch) && !unicode.IsDigit(ch)
+	})
+}
+
+func reverseString(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
+
+func (vi *verticalIndex) put(item *indexedItem) {
+	vi.delete(item.ID)
+	item.words = tokenize(item.Title)
+	for _, w := range item.words {
+		vi.root.insert(w, item.ID)
+	}
+	vi.items[item.ID] = item
+}
+
+func (vi *verticalIndex) delete(id int) {
+	if old, ok := vi.items[id]; ok {
+		for _, w := range old.words {
+			vi.root.remove(w, id)
+		}
+		delete(vi.items, id)
+	}
+}
+
+// match returns the items having, for every word of term, a word that
+// starts with it.
+func (vi *verticalIndex) match(term string) map[int]struct{} {
+	words := tokenize(term)
+	if len(words) == 0 {
+		return nil
+	}
+	var result map[int]struct{}
+	for _, w := range words {
+		ids := vi.root.find(w)
+		if result == nil {
+			result = make(map[int]struct{}, len(ids))
+			for id := range ids {
+				result[id] = struct{}{}
+			}
+			continue
+		}
+		for id := range result {
+			if _, ok := ids[id]; !ok {
+				delete(result, id)
+			}
+		}
+	}
+	return result
+}
+
+// Ready reports whether the index can serve suggestions.
+func (idx *SuggestionIndex) Ready() bool {
+	if idx == nil {
+		return false
+	}
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.ready
+}
+
+// SearchIds is the in-memory counterpart of ProductSearchIds and
+// ShopProductSearchIds. Like them it also matches the term typed backwards
+// and the term's synonyms.
+func (idx *SuggestionIndex) SearchIds(ctx context.Context, v *Vertical, term string) (total int, ids []int) {
+	if v.Source == sourceCategories {
+		return postgresBackend{}.SearchIds(ctx, v, term)
+	}
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	vi := idx.verticals[v.Name]
+	if vi == nil {
+		return
+	}
+
+	var matched map[int]struct{}
+	if strings.TrimSpace(term) == "" {
+		matched = make(map[int]struct{}, len(vi.items))
+		for id := range vi.items {
+			matched[id] = struct{}{}
+		}
+	} else {
+		matched = vi.matchAny(term)
+	}
+
+	hits := idx.score(vi, matched, func(item *indexedItem) float64 { return textScore(item, term) })
+	if v.Order == orderNewest || strings.TrimSpace(term) == "" {
+		sort.Slice(hits, func(i, j int) bool { return hits[i].id > hits[j].id })
+	}
+
+	total = len(hits)
+	for i := 0; i < len(hits) && (v.Limit <= 0 || i < v.Limit); i++ {
+		ids = append(ids, hits[i].id)
+	}
+	return
+}
+
+// FuzzySearchIds mirrors ProductFuzzySearchIds with trigram similarity
+// computed in Go.
+func (idx *SuggestionIndex) FuzzySearchIds(ctx context.Context, v *Vertical, term string) (result FuzzyResult) {
+	if v.Source == sourceCategories {
+		return postgresBackend{}.FuzzySearchIds(ctx, v, term)
+	}
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	vi := idx.verticals[v.Name]
+	if vi == nil || strings.TrimSpace(term) == "" {
+		return
+	}
+
+	matched := vi.matchAny(term)
+	for id, item := range vi.items {
+		if sim, _ := wordSimilarity(term, item.words); sim > fuzzy.Threshold {
+			matched[id] = struct{}{}
+		}
+	}
+
+	hits := idx.score(vi, matched, func(item *indexedItem) float64 {
+		sim, _ := wordSimilarity(term, item.words)
+		return textScore(item, term) + fuzzy.Weight*sim
+	})
+
+	result.Total = len(hits)
+	for i := 0; i < len(hits) && (v.Limit <= 0 || i < v.Limit); i++ {
+		result.Ids = append(result.Ids, hits[i].id)
+	}
+	if len(hits) > 0 {
+		_, result.Corrected = wordSimilarity(term, vi.items[hits[0].id].words)
+	}
+	return
+}
+
+type scoredItem struct {
+	id    int
+	score float64
+}
+
+// score ranks the matched items inside their validity window, best first
+// and by id on ties, so the order never depends on map iteration.
+func (idx *SuggestionIndex) score(vi *verticalIndex, matched map[int]struct{}, text func(*indexedItem) float64) []scoredItem {
+	now := idx.now()
+	weights := currentRanking()
+	var hits []scoredItem
+	for id := range matched {
+		item := vi.items[id]
+		if now.Before(item.StartsAt) || now.After(item.EndsAt) {
+			continue
+		}
+		hits = append(hits, scoredItem{id, rankingScore(weights, text(item), item.Sold, item.StartsAt, item.EndsAt, now)})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].score != hits[j].score {
+			return hits[i].score > hits[j].score
+		}
+		return hits[i].id > hits[j].id
+	})
+	return hits
+}
+
+// matchAny matches term, term typed backwards and the synonyms of term.
+func (vi *verticalIndex) matchAny(term string) map[int]struct{} {
+	matched := map[int]struct{}{}
+	for _, t := range append([]string{term, reverseString(term)}, synonymsFor(term)...) {
+		for id := range vi.match(t) {
+			matched[id] = struct{}{}
+		}
+	}
+	return matched
+}
+
+// trigrams splits s into pg_trgm style trigrams: each word lowercased and
+// padded with two spaces in front and one behind.
+func trigrams(s string) map[string]struct{} {
+	result := map[string]struct{}{}
+	for _, word := range tokenize(s) {
+		runes := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(runes); i++ {
+			result[string(runes[i:i+3])] = struct{}{}
+		}
+	}
+	return result
+}
+
+// wordSimilarity approximates pg_trgm word_similarity: the best trigram
+// similarity between term and a single word of the title.
+func wordSimilarity(term string, words []string) (best float64, bestWord string) {
+	t := trigrams(term)
+	if len(t) == 0 {
+		return
+	}
+	for _, w := range words {
+		wt := trigrams(w)
+		common := 0
+		for g := range t {
+			if _, ok := wt[g]; ok {
+				common++
+			}
+		}
+		if sim := float64(common) / float64(len(t)+len(wt)-common); sim > best {
+			best, bestWord = sim, w
+		}
+	}
+	return
+}
+
+// textScore stands in for ts_rank: whole word matches beat prefixes.
+func textScore(item *indexedItem, term string) float64 {
+	words := tokenize(term)
+	if len(words) == 0 {
+		return 0
+	}
+	exact := 0
+	for _, w := range words {
+		for _, iw := range item.words {
+			if iw == w {
+				exact++
+				break
+			}
+		}
+	}
+	return 0.05 + 0.05*float64(exact)/float64(len(words))
+}
+
+// Items hydrates ids like filterCoupons and filterShopProducts, keeping
+// their order.
+func (idx *SuggestionIndex) Items(ctx context.Context, v *Vertical, ids []int) (result SearchSuggestions) {
+	if v.Source == sourceCategories {
+		return postgresBackend{}.Items(ctx, v, ids)
+	}
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	result = SearchSuggestions{}
+	vi := idx.verticals[v.Name]
+	if vi == nil {
+		return
+	}
+	for _, id := range ids {
+		if item, ok := vi.items[id]; ok {
+			result = append(result, item.SearchSuggestion)
+		}
+	}
+	return
+}
+
+// maintain builds the index, then keeps it current by polling updated_at
+// and, when listen is set, by LISTEN on search_index_changed, with a full
+// rebuild every hour for changes neither of them sees (category moves,
+// final-sale and adults-only membership).
+func (idx *SuggestionIndex) maintain(listen bool) {
+	idx.rebuild()
+
+	var notifications <-chan *pq.Notification
+	if listen && !hasNotifyTriggers("notify_search_index_changed", indexNotifyChannel) {
+		listen = false
+	}
+	if listen {
+		listener := pq.NewListener(config.DatabaseURL, time.Second, time.Minute, nil)
+		if err := listener.Listen(indexNotifyChannel); err != nil {
+			fmt.Println("Unable to listen for search index changes:", err)
+		} else {
+			notifications = listener.NotificationChannel()
+		}
+	}
+
+	poll := time.NewTicker(indexPollInterval)
+	rebuild := time.NewTicker(indexRebuildInterval)
+	for {
+		select {
+		case <-rebuild.C:
+			idx.rebuild()
+		case <-poll.C:
+			idx.poll()
+		case n := <-notifications:
+			// nil after a reconnect: we may have missed some, catch up
+			if n == nil {
+				idx.poll()
+				continue
+			}
+			idx.notified(n.Extra)
+		}
+	}
+}
+
+// hasNotifyTriggers reports whether some trigger calls function to send
+// on channel; without one a listener would wait forever, so polling has
+// to do.
+func hasNotifyTriggers(function, channel string) bool {
+	var found bool
+	request := heredoc.Doc(`
+		SELECT EXISTS (
+			SELECT 1 FROM pg_trigger JOIN pg_proc ON pg_proc.oid = pg_trigger.tgfoid
+			WHERE pg_proc.proname = $1 AND NOT pg_trigger.tgisinternal
+		)
+	`)
+	if err := dbx.Get(&found, request, function); err != nil {
+		fmt.Printf("Unable to look for the %s triggers: %v\n", channel, err)
+		return false
+	}
+	if !found {
+		fmt.Printf("Nothing sends %s, run migrate up; polling instead\n", channel)
+	}
+	return found
+}
+
+func (idx *SuggestionIndex) rebuild() {
+	started := time.Now()
+	watermarks, ok := indexWatermarks()
+	if !ok {
+		return
+	}
+
+	built := map[string]*verticalIndex{}
+	for _, v := range verticals {
+		if v.Source == sourceCategories {
+			continue
+		}
+		items, err := loadIndexItems(v, nil)
+		if err != nil {
+			fmt.Printf("Unable to index vertical %s: %v\n", v.Name, err)
+			return
+		}
+		built[v.Name] = newVerticalIndex(items)
+	}
+
+	idx.mu.Lock()
+	idx.verticals, idx.watermarks, idx.ready = built, watermarks, true
+	idx.mu.Unlock()
+	fmt.Println("suggestion index built in", time.Since(started))
+}
+
+// poll reindexes the products changed since the last look, including shop
+// products whose sale changed.
+func (idx *SuggestionIndex) poll() {
+	idx.mu.RLock()
+	since := idx.watermarks
+	idx.mu.RUnlock()
+
+	watermarks, ok := indexWatermarks()
+	if !ok {
+		return
+	}
+
+	changed := map[string][]int{}
+	var ids []int
+	if err := dbx.Select(&ids, `SELECT id FROM products WHERE updated_at > $1`, since["products"]); err != nil {
+		fmt.Println("Unable to poll products:", err)
+		return
+	}
+	changed[sourceProducts] = ids
+
+	ids = nil
+	request := heredoc.Doc(`
+		SELECT shop_products.id
+		FROM shop_products
+		JOIN shop_sales ON shop_products.sale_id = shop_sales.id
+		WHERE shop_products.updated_at > $1 OR shop_sales.updated_at > $2
+	`)
+	if err := dbx.Select(&ids, request, since["shop_products"], since["shop_sales"]); err != nil {
+		fmt.Println("Unable to poll shop products:", err)
+		return
+	}
+	changed[sourceShopProducts] = ids
+
+	idx.reindex(changed)
+
+	idx.mu.Lock()
+	idx.watermarks = watermarks
+	idx.mu.Unlock()
+}
+
+// notified handles a "<table>:<id>" payload sent by the triggers on
+// products, shop_products and shop_sales.
+func (idx *SuggestionIndex) notified(payload string) {
+	parts := strings.SplitN(payload, ":", 2)
+	if len(parts) != 2 {
+		return
+	}
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return
+	}
+
+	switch parts[0] {
+	case "products":
+		idx.reindex(map[string][]int{sourceProducts: {id}})
+	case "shop_products":
+		idx.reindex(map[string][]int{sourceShopProducts: {id}})
+	case "shop_sales":
+		var ids []int
+		if err = dbx.Select(&ids, `SELECT id FROM shop_products WHERE sale_id = $1`, id); err != nil {
+			fmt.Println("Unable to load products of sale", id, err)
+			return
+		}
+		idx.reindex(map[string][]int{sourceShopProducts: ids})
+	}
+}
+
+// reindex reloads the given ids, by source, into every vertical built on
+// that source; those no longer qualifying are dropped.
+func (idx *SuggestionIndex) reindex(changed map[string][]int) {
+	for _, v := range verticals {
+		ids := changed[v.Source]
+		if len(ids) == 0 {
+			continue
+		}
+		items, err := loadIndexItems(v, ids)
+		if err != nil {
+			fmt.Printf("Unable to reindex vertical %s: %v\n", v.Name, err)
+			continue
+		}
+
+		idx.mu.Lock()
+		vi := idx.verticals[v.Name]
+		if vi != nil {
+			for _, id := range ids {
+				vi.delete(id)
+			}
+			for _, item := range items {
+				vi.put(item)
+			}
+		}
+		idx.mu.Unlock()
+	}
+}
+
+func indexWatermarks() (watermarks map[string]time.Time, ok bool) {
+	watermarks = map[string]time.Time{}
+	for _, table := range []string{"products", "shop_products", "shop_sales"} {
+		var t time.Time
+		if err := dbx.Get(&t, fmt.Sprintf(`SELECT COALESCE(MAX(updated_at), 'epoch') FROM %s`, table)); err != nil {
+			fmt.Println("Unable to read index watermark:", err)
+			return
+		}
+		watermarks[table] = t
+	}
+	return watermarks, true
+}
+
+// loadIndexItems selects the items of a vertical that are or will become
+// searchable, all of them or only those in ids. The SQL applies the
+// vertical's own rules and leaves out what has ended; eligible does the
+// rest.
+func loadIndexItems(v *Vertical, ids []int) (items []*indexedItem, err error) {
+	ctx := context.Background()
+	only := ""
+	if ids != nil {
+		only = fmt.Sprintf(`AND "%s"."id" IN (%s)`, v.Source, arrayToString(ids, ","))
+	}
+
+	var request string
+	if v.Source == sourceShopProducts {
+		finalSaleIds, ok := finalSaleProductIds(ctx)
+		if !ok {
+			return nil, fmt.Errorf("final sale lookup failed")
+		}
+		request = heredoc.Docf(`
+			SELECT shop_products.id, COALESCE(shop_products.title, '') title, '' system_name, shop_products.sale_id,
+				shop_sales.start_date starts_at, shop_sales.end_date ends_at,
+				COALESCE(SUM(shop_catalogs.quantity_bought), 0)::float8 sold,
+				COALESCE(shop_sales.status = 'READY', false) ready, COALESCE(shop_sales.hidden, true) hidden,
+				shop_products.id IN (%s) final_sale, COALESCE(shop_products.delivery_product, true) delivery
+			FROM shop_products
+			INNER JOIN shop_option_types ON shop_option_types.product_id = shop_products.id
+			INNER JOIN shop_catalogs ON shop_catalogs.option_type_id = shop_option_types.id
+			JOIN shop_sales ON shop_products.sale_id = shop_sales.id
+			WHERE shop_sales.end_date > %s
+				%s %s %s
+			GROUP BY shop_products.id, shop_sales.id
+		`, arrayToString(finalSaleIds, ","), timestampSQL(localTimestamp()), whereClause(v.Where), getAO(ctx, "shop_"), only)
+	} else {
+		request = heredoc.Docf(`
+			SELECT products.id, COALESCE(products.title, '') title, COALESCE(products.system_name, '') system_name, 0 sale_id,
+				valid_from starts_at, valid_until ends_at, %s sold,
+				COALESCE(ready AND visible, false) ready, false hidden, false final_sale, false delivery
+			FROM products
+			WHERE valid_until > %s
+				%s %s %s
+		`, couponsSoldSQL, timestampSQL(localTimestamp()), whereClause(v.Where), getAO(ctx, ""), only)
+	}
+
+	var candidates []*indexCandidate
+	if err = dbx.Select(&candidates, request); err != nil {
+		return
+	}
+	return indexItems(candidates), nil
+}
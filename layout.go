@@ -0,0 +1,133 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Key positions of the standard Israeli (SI-1452) keyboard, indexed by the
+// QWERTY character on the same key.
+var latinToHebrew = map[rune]rune{
+	'q': '/', 'w': '\'', 'e': 'ק', 'r': 'ר', 't': 'א', 'y': 'ט', 'u': 'ו', 'i': 'ן', 'o': 'ם', 'p': 'פ',
+	'a': 'ש', 's': 'ד', 'd': 'ג', 'f': 'כ', 'g': 'ע', 'h': 'י', 'j': 'ח', 'k': 'ל', 'l': 'ך', ';': 'ף',
+	'z': 'ז', 'x': 'ס', 'c': 'ב', 'v': 'ה', 'b': 'נ', 'n': 'מ', 'm': 'צ', ',': 'ת', '.': 'ץ', '/': '.',
+	'\'': ',',
+}
+
+var hebrewToLatin = map[rune]rune{}
+
+func init() {
+	for l, h := range latinToHebrew {
+		hebrewToLatin[h] = l
+	}
+}
+
+// Hebrew letters that are only written at the end of a word.
+const hebrewFinals = "ךםןףץ"
+
+// switchLayout maps a term typed with the wrong keyboard layout active to
+// what the same keys produce in the other layout. converted is empty when
+// the term has no such reading; likely reports whether the term looks
+// mistyped on its own, without asking the database.
+func switchLayout(term string) (converted string, likely bool) {
+	term = strings.ToLower(strings.TrimSpace(term))
+	if term == "" {
+		return
+	}
+
+	hebrew, latin := 0, 0
+	for _, ch := range term {
+		switch {
+		case ch >= 'א' && ch <= 'ת':
+			hebrew++
+		case ch >= 'a' && ch <= 'z':
+			latin++
+		}
+	}
+
+	switch {
+	case latin > 0 && hebrew == 0:
+		return latinAsHebrew(term)
+	case hebrew > 0 && latin == 0:
+		return hebrewAsLatin(term)
+	}
+	return
+}
+
+// latinAsHebrew reads term as Hebrew typed on an English layout.
+func latinAsHebrew(term string) (converted string, likely bool) {
+	out, ok := mapRunes(term, latinToHebrew)
+	if !ok || !validHebrewFinals(out) {
+		return
+	}
+
+	for _, word := range strings.Fields(term) {
+		runes := []rune(word)
+		letters, vowels := 0, 0
+		for i, ch := range runes {
+			switch {
+			case strings.ContainsRune("aeiouy", ch):
+				letters++
+				vowels++
+			case ch >= 'a' && ch <= 'z':
+				letters++
+			case strings.ContainsRune(",.;'", ch) && len(runes) > 1 && (i > 0 || unicode.IsLetter(runes[1])):
+				// punctuation glued to letters is a Hebrew letter key
+				likely = true
+			}
+		}
+		if letters >= 3 && vowels == 0 {
+			likely = true
+		}
+	}
+	for _, word := range strings.Fields(out) {
+		runes := []rune(word)
+		if len(runes) > 1 && strings.ContainsRune(hebrewFinals, runes[len(runes)-1]) {
+			likely = true
+		}
+	}
+
+	return out, likely
+}
+
+// hebrewAsLatin reads term as English typed on a Hebrew layout.
+func hebrewAsLatin(term string) (converted string, likely bool) {
+	out, ok := mapRunes(term, hebrewToLatin)
+	if !ok {
+		return
+	}
+	// final letters in the middle of a word never happen in real Hebrew
+	likely = !validHebrewFinals(term)
+	return out, likely
+}
+
+func mapRunes(term string, mapping map[rune]rune) (string, bool) {
+	var out []rune
+	for _, ch := range term {
+		if unicode.IsSpace(ch) || unicode.IsDigit(ch) || ch == '-' {
+			out = append(out, ch)
+			continue
+		}
+		mapped, ok := mapping[ch]
+		if !ok {
+			return "", false
+		}
+		out = append(out, mapped)
+	}
+	return string(out), true
+}
+
+// validHebrewFinals reports whether final letter forms appear only at the
+// end of words.
+func validHebrewFinals(s string) bool {
+	for _, word := range strings.Fields(s) {
+		runes := []rune(word)
+		for i, ch := range runes {
+			last := i == len(runes)-1 || !unicode.IsLetter(runes[i+1])
+			if !last && strings.ContainsRune(hebrewFinals, ch) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSwitchLayout(t *testing.T) {
+	f, err := os.Open("testdata/layout_queries.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if scanner.Text() == "" || strings.HasPrefix(scanner.Text(), "#") {
+			continue
+		}
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 3 {
+			t.Fatalf("line %d: want 3 tab separated fields, got %d", line, len(fields))
+		}
+		input, want, wantLikely := fields[0], fields[1], fields[2] == "true"
+
+		converted, likely := switchLayout(input)
+		if converted != want {
+			t.Errorf("switchLayout(%q) converted = %q, want %q", input, converted, want)
+		}
+		if likely != wantLikely {
+			t.Errorf("switchLayout(%q) likely = %v, want %v", input, likely, wantLikely)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
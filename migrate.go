@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MakeNowJust/heredoc"
+)
+
+// migrationFiles holds NNNN_name.up.sql and NNNN_name.down.sql pairs,
+// applied in version order.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockKey is the advisory lock serializing migrations, so dynos
+// booting together with AUTO_MIGRATE do not race.
+const migrationLockKey = 20460001
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// A migration file starting with noTransaction runs a statement at a time,
+// outside a transaction, as CREATE INDEX CONCURRENTLY requires; a failure
+// leaves the statements before it applied, so each must be safe to run
+// again. A statement under an unlessIndexed line naming a table and column
+// is skipped when the table is missing or a valid index on it already
+// starts with that column, whatever its name.
+//
+// A statement under an ownsIndex line creates or drops the index named.
+// Going up, an invalid index left by an interrupted build is dropped first,
+// a valid one of that name is kept instead and the one built is marked as
+// the migration's; going down, only an index so marked is dropped.
+const noTransaction = "-- migrate:no-transaction"
+
+var (
+	unlessIndexed = regexp.MustCompile(`(?m)^-- migrate:unless-indexed (\w+) \((\w+)\)$`)
+	ownsIndex     = regexp.MustCompile(`(?m)^-- migrate:owns-index (\w+)$`)
+)
+
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type appliedMigration struct {
+	Version   int       `db:"version"`
+	Name      string    `db:"name"`
+	AppliedAt time.Time `db:"applied_at"`
+}
+
+func loadMigrations() (migrations []*migration, err error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return
+	}
+	byVersion := map[int]*migration{}
+	for _, e := range entries {
+		m := migrationFileName.FindStringSubmatch(e.Name())
+		if m == nil {
+			return nil, fmt.Errorf("migrations/%s: want NNNN_name.up.sql or NNNN_name.down.sql", e.Name())
+		}
+		version, _ := strconv.Atoi(m[1])
+		body, err := migrationFiles.ReadFile(path.Join("migrations", e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		mig := byVersion[version]
+		if mig == nil {
+			mig = &migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+			migrations = append(migrations, mig)
+		} else if mig.Name != m[2] {
+			return nil, fmt.Errorf("migrations: version %d is both %s and %s", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(body)
+		} else {
+			mig.Down = string(body)
+		}
+	}
+	for _, mig := range migrations {
+		if mig.Up == "" || mig.Down == "" {
+			return nil, fmt.Errorf("migrations: %04d_%s needs both an up and a down file", mig.Version, mig.Name)
+		}
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return
+}
+
+// withMigrationLock runs f on a connection holding the migration lock,
+// with schema_migrations in place.
+func withMigrationLock(f func(ctx context.Context, conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := dbx.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey); err != nil {
+		return fmt.Errorf("taking the migration lock: %v", err)
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+
+	request := heredoc.Doc(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    integer PRIMARY KEY,
+			name       text NOT NULL,
+			applied_at timestamp NOT NULL DEFAULT now()
+		)
+	`)
+	if _, err = conn.ExecContext(ctx, request); err != nil {
+		return fmt.Errorf("creating schema_migrations: %v", err)
+	}
+	return f(ctx, conn)
+}
+
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (applied map[int]appliedMigration, err error) {
+	rows, err := conn.QueryContext(ctx, `SELECT version, name, applied_at FROM schema_migrations`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	applied = map[int]appliedMigration{}
+	for rows.Next() {
+		var a appliedMigration
+		if err = rows.Scan(&a.Version, &a.Name, &a.AppliedAt); err != nil {
+			return
+		}
+		applied[a.Version] = a
+	}
+	return applied, rows.Err()
+}
+
+// runMigration applies one direction of mig and records it, in a single
+// transaction unless the file asks for none.
+func runMigration(ctx context.Context, conn *sql.Conn, mig *migration, up bool) error {
+	body, record, args := mig.Down, `DELETE FROM schema_migrations WHERE version = $1`, []interface{}{mig.Version}
+	if up {
+		body, record, args = mig.Up, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, []interface{}{mig.Version, mig.Name}
+	}
+	if strings.HasPrefix(body, noTransaction) {
+		owner := fmt.Sprintf("created by migration %04d_%s", mig.Version, mig.Name)
+		if err := runStatements(ctx, conn, body, owner, up); err != nil {
+			return fmt.Errorf("%04d_%s: %v", mig.Version, mig.Name, err)
+		}
+		_, err := conn.ExecContext(ctx, record, args...)
+		return err
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.ExecContext(ctx, body); err != nil {
+		return fmt.Errorf("%04d_%s: %v", mig.Version, mig.Name, err)
+	}
+	if _, err = tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// runStatements runs the ;-terminated statements of body one by one, each
+// on its own so none is wrapped in an implicit transaction. owner marks the
+// indexes the migration creates.
+func runStatements(ctx context.Context, conn *sql.Conn, body, owner string, up bool) error {
+	for _, statement := range strings.Split(body, ";\n") {
+		if !hasSQL(statement) {
+			continue
+		}
+		skip := false
+		for _, m := range unlessIndexed.FindAllStringSubmatch(statement, -1) {
+			indexed, err := hasIndexOn(ctx, conn, m[1], m[2])
+			if err != nil {
+				return err
+			}
+			skip = skip || indexed
+		}
+		owned := ownsIndex.FindAllStringSubmatch(statement, -1)
+		for _, m := range owned {
+			if skip {
+				break
+			}
+			run, err := claimIndex(ctx, conn, m[1], owner, up)
+			if err != nil {
+				return err
+			}
+			skip = !run
+		}
+		if skip {
+			continue
+		}
+		if _, err := conn.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+		for _, m := range owned {
+			if !up {
+				break
+			}
+			if _, err := conn.ExecContext(ctx, fmt.Sprintf(`COMMENT ON INDEX %s IS '%s'`, m[1], owner)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// claimIndex tells whether the statement creating, or dropping, index
+// should run: going up when there is no valid index of that name, after
+// dropping an invalid one; going down when the index carries owner.
+func claimIndex(ctx context.Context, conn *sql.Conn, index, owner string, up bool) (run bool, err error) {
+	var (
+		valid   bool
+		comment sql.NullString
+	)
+	request := `SELECT indisvalid, obj_description(indexrelid, 'pg_class') FROM pg_index WHERE indexrelid = to_regclass($1)`
+	switch err = conn.QueryRowContext(ctx, request, index).Scan(&valid, &comment); {
+	case err == sql.ErrNoRows:
+		return up, nil
+	case err != nil:
+		return
+	case !up:
+		return comment.String == owner, nil
+	case valid:
+		return false, nil
+	}
+	if _, err = conn.ExecContext(ctx, `DROP INDEX CONCURRENTLY `+index); err != nil {
+		return false, fmt.Errorf("dropping the invalid index %s: %v", index, err)
+	}
+	return true, nil
+}
+
+// hasSQL tells whether statement is more than blank lines and comments.
+func hasSQL(statement string) bool {
+	for _, line := range strings.Split(statement, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "--") {
+			return true
+		}
+	}
+	return false
+}
+
+// hasIndexOn tells whether table is missing or has a valid index starting
+// with column.
+func hasIndexOn(ctx context.Context, conn *sql.Conn, table, column string) (indexed bool, err error) {
+	request := heredoc.Doc(`
+		SELECT to_regclass($1) IS NULL OR EXISTS (
+			SELECT 1 FROM pg_index
+			JOIN pg_attribute ON pg_attribute.attrelid = pg_index.indrelid AND pg_attribute.attnum = pg_index.indkey[0]
+			WHERE pg_index.indrelid = to_regclass($1) AND pg_index.indisvalid AND pg_attribute.attname = $2
+		)
+	`)
+	err = conn.QueryRowContext(ctx, request, table, column).Scan(&indexed)
+	return
+}
+
+// migrateUp applies every pending migration, in order.
+func migrateUp(w io.Writer) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	return withMigrationLock(func(ctx context.Context, conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mig := range migrations {
+			if _, ok := applied[mig.Version]; ok {
+				continue
+			}
+			if err = runMigration(ctx, conn, mig, true); err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "applied %04d_%s\n", mig.Version, mig.Name)
+		}
+		return nil
+	})
+}
+
+// migrateDown reverts the latest steps applied migrations.
+func migrateDown(w io.Writer, steps int) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	return withMigrationLock(func(ctx context.Context, conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+			mig := migrations[i]
+			if _, ok := applied[mig.Version]; !ok {
+				continue
+			}
+			if err = runMigration(ctx, conn, mig, false); err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "reverted %04d_%s\n", mig.Version, mig.Name)
+			steps--
+		}
+		return nil
+	})
+}
+
+// migrateStatus lists every migration with when it was applied, and any
+// applied version this binary does not know.
+func migrateStatus(w io.Writer) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	return withMigrationLock(func(ctx context.Context, conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mig := range migrations {
+			status := "pending"
+			if a, ok := applied[mig.Version]; ok {
+				status = "applied " + a.AppliedAt.Format("2006-01-02 15:04:05")
+				delete(applied, mig.Version)
+			}
+			fmt.Fprintf(w, "%04d_%-30s %s\n", mig.Version, mig.Name, status)
+		}
+		var unknown []int
+		for version := range applied {
+			unknown = append(unknown, version)
+		}
+		sort.Ints(unknown)
+		for _, version := range unknown {
+			a := applied[version]
+			fmt.Fprintf(w, "%04d_%-30s applied, unknown to this build\n", a.Version, a.Name)
+		}
+		return nil
+	})
+}
+
+// runMigrate handles "migrate up", "migrate down [steps]" and
+// "migrate status".
+func runMigrate(w io.Writer, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up|down [steps]|status")
+	}
+	switch args[0] {
+	case "up":
+		return migrateUp(w)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("migrate down: steps must be a positive number, got %q", args[1])
+			}
+			steps = n
+		}
+		return migrateDown(w, steps)
+	case "status":
+		return migrateStatus(w)
+	}
+	return fmt.Errorf("migrate: unknown command %q, want up, down or status", args[0])
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+func TestMigrationOwnsIndexes(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	db := openTestSchema(t, url)
+	defer db.Close()
+	ctx := context.Background()
+	conn, err := db.DB.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// products_tsv is taken by an index of the main application on another
+	// column, shop_products has none
+	for _, statement := range []string{
+		`CREATE TABLE schema_migrations (version integer PRIMARY KEY, name text NOT NULL, applied_at timestamp NOT NULL DEFAULT now())`,
+		`CREATE TABLE products (id integer, tsv tsvector)`,
+		`CREATE TABLE shop_products (id integer, tsv tsvector)`,
+		`CREATE INDEX products_tsv ON products (id)`,
+	} {
+		if _, err = conn.ExecContext(ctx, statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mig *migration
+	for _, m := range migrations {
+		if m.Name == "search_text_indexes" {
+			mig = m
+		}
+	}
+
+	exists := func(index string) (ok bool) {
+		t.Helper()
+		if err := conn.QueryRowContext(ctx, `SELECT to_regclass($1) IS NOT NULL`, index).Scan(&ok); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	if err = runMigration(ctx, conn, mig, true); err != nil {
+		t.Fatal(err)
+	}
+	if !exists("shop_products_tsv") {
+		t.Error("shop_products_tsv was not built")
+	}
+	if err = runMigration(ctx, conn, mig, false); err != nil {
+		t.Fatal(err)
+	}
+	if exists("shop_products_tsv") {
+		t.Error("rolling back kept the shop_products_tsv it built")
+	}
+	if !exists("products_tsv") {
+		t.Error("rolling back dropped the products_tsv that was there before")
+	}
+}
@@ -0,0 +1,3 @@
+-- The table and its tracking columns predate these migrations and are
+-- shared with the main application, so there is nothing to undo.
+SELECT 1;
@@ -0,0 +1,12 @@
+-- email_subscriptions belongs to the main application; this service only
+-- records opens and clicks on it. Create it for a fresh database and add
+-- the tracking columns where they are missing. Its email index is built
+-- by 0009, concurrently.
+CREATE TABLE IF NOT EXISTS email_subscriptions (
+	id serial PRIMARY KEY,
+	email varchar(255) NOT NULL
+);
+ALTER TABLE email_subscriptions
+	ADD COLUMN IF NOT EXISTS opened_at timestamp,
+	ADD COLUMN IF NOT EXISTS clicked_at timestamp,
+	ADD COLUMN IF NOT EXISTS last_clicked_url varchar(255);
@@ -0,0 +1,2 @@
+-- The tsv columns stay: the main application fills them.
+SELECT 1;
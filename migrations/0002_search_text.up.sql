@@ -0,0 +1,16 @@
+-- Text search over the main application's products and shop_products: the
+-- tsv columns the suggestion queries match with @@, and pg_trgm for the
+-- fuzzy fallback. Tables that do not exist yet are skipped. The GIN
+-- indexes on tsv are built by 0010, concurrently.
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+DO $$
+BEGIN
+	IF to_regclass('products') IS NOT NULL THEN
+		ALTER TABLE products ADD COLUMN IF NOT EXISTS tsv tsvector;
+	END IF;
+	IF to_regclass('shop_products') IS NOT NULL THEN
+		ALTER TABLE shop_products ADD COLUMN IF NOT EXISTS tsv tsvector;
+	END IF;
+END
+$$;
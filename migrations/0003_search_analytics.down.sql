@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS search_clicks;
+DROP TABLE IF EXISTS search_queries;
+DROP TABLE IF EXISTS search_synonyms;
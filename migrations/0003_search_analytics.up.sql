@@ -0,0 +1,29 @@
+CREATE TABLE IF NOT EXISTS search_queries (
+	search_id  text PRIMARY KEY,
+	term       text NOT NULL,
+	normalized text NOT NULL,
+	session_id text NOT NULL,
+	counts     jsonb NOT NULL,
+	total      integer NOT NULL,
+	latency_ms integer NOT NULL,
+	created_at timestamp NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS search_queries_normalized_created_at ON search_queries (normalized, created_at);
+
+CREATE TABLE IF NOT EXISTS search_clicks (
+	id         bigserial PRIMARY KEY,
+	search_id  text NOT NULL,
+	session_id text NOT NULL,
+	vertical   text NOT NULL,
+	href       text NOT NULL,
+	position   integer NOT NULL,
+	created_at timestamp NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS search_clicks_search_id ON search_clicks (search_id);
+
+CREATE TABLE IF NOT EXISTS search_synonyms (
+	term       text NOT NULL,
+	synonym    text NOT NULL,
+	created_at timestamp NOT NULL DEFAULT now(),
+	PRIMARY KEY (term, synonym)
+);
@@ -0,0 +1,3 @@
+-- Dropping the functions drops the triggers using them.
+DROP FUNCTION IF EXISTS notify_search_index_changed() CASCADE;
+DROP FUNCTION IF EXISTS notify_category_tree_changed() CASCADE;
@@ -0,0 +1,44 @@
+-- NOTIFY search_index_changed with "<table>:<id>" when a product, shop
+-- product or sale changes, for the suggestion index, and
+-- category_tree_changed when the categories do, for the category tree.
+CREATE OR REPLACE FUNCTION notify_search_index_changed() RETURNS trigger AS $$
+DECLARE
+	row_id integer;
+BEGIN
+	IF TG_OP = 'DELETE' THEN
+		row_id := OLD.id;
+	ELSE
+		row_id := NEW.id;
+	END IF;
+	PERFORM pg_notify('search_index_changed', TG_TABLE_NAME || ':' || row_id);
+	RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION notify_category_tree_changed() RETURNS trigger AS $$
+BEGIN
+	PERFORM pg_notify('category_tree_changed', TG_TABLE_NAME);
+	RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+
+DO $$
+DECLARE
+	t text;
+BEGIN
+	FOREACH t IN ARRAY ARRAY['products', 'shop_products', 'shop_sales'] LOOP
+		IF to_regclass(t) IS NOT NULL THEN
+			EXECUTE format('DROP TRIGGER IF EXISTS %I_search_index_changed ON %I', t, t);
+			EXECUTE format('CREATE TRIGGER %I_search_index_changed AFTER INSERT OR UPDATE OR DELETE ON %I
+				FOR EACH ROW EXECUTE PROCEDURE notify_search_index_changed()', t, t);
+		END IF;
+	END LOOP;
+	FOREACH t IN ARRAY ARRAY['categories', 'sub_categories', 'categories_sub_categories'] LOOP
+		IF to_regclass(t) IS NOT NULL THEN
+			EXECUTE format('DROP TRIGGER IF EXISTS %I_category_tree_changed ON %I', t, t);
+			EXECUTE format('CREATE TRIGGER %I_category_tree_changed AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON %I
+				FOR EACH STATEMENT EXECUTE PROCEDURE notify_category_tree_changed()', t, t);
+		END IF;
+	END LOOP;
+END
+$$;
@@ -0,0 +1,24 @@
+-- email_events keeps every SendGrid event received, sg_event_id making a
+-- redelivered one a no-op. email_suppressions lists the addresses SendGrid
+-- will not deliver to any more: bounced, dropped, reported as spam or
+-- unsubscribed.
+CREATE TABLE IF NOT EXISTS email_events (
+	id            bigserial PRIMARY KEY,
+	sg_event_id   text UNIQUE,
+	sg_message_id text,
+	event         text NOT NULL,
+	email         text NOT NULL,
+	category      text,
+	url           text,
+	happened_at   timestamp NOT NULL,
+	payload       jsonb NOT NULL,
+	created_at    timestamp NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS email_events_email_happened_at ON email_events (email, happened_at);
+CREATE INDEX IF NOT EXISTS email_events_happened_at ON email_events (happened_at);
+
+CREATE TABLE IF NOT EXISTS email_suppressions (
+	email      text PRIMARY KEY,
+	reason     text NOT NULL,
+	created_at timestamp NOT NULL DEFAULT now()
+);
@@ -0,0 +1,9 @@
+-- Events the writer failed to register, kept for "dlq retry".
+CREATE TABLE IF NOT EXISTS email_dead_letters (
+	id         bigserial PRIMARY KEY,
+	payload    jsonb NOT NULL,
+	error      text NOT NULL,
+	attempts   integer NOT NULL DEFAULT 1,
+	created_at timestamp NOT NULL DEFAULT now(),
+	failed_at  timestamp NOT NULL DEFAULT now()
+);
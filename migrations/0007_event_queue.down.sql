@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS email_event_daily;
+DROP TABLE IF EXISTS job_runs;
+DROP TABLE IF EXISTS event_jobs;
@@ -0,0 +1,30 @@
+-- event_jobs queues the posted SendGrid events for the workers of every
+-- instance, which claim them with FOR UPDATE SKIP LOCKED and hold them
+-- until locked_until. A failed job is retried at run_at.
+CREATE TABLE IF NOT EXISTS event_jobs (
+	id           bigserial PRIMARY KEY,
+	payload      jsonb NOT NULL,
+	attempts     integer NOT NULL DEFAULT 0,
+	run_at       timestamp NOT NULL DEFAULT now(),
+	locked_until timestamp,
+	last_error   text,
+	created_at   timestamp NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS event_jobs_run_at ON event_jobs (run_at, id);
+
+-- job_runs remembers when each singleton job last ran, so that only one
+-- instance runs it per interval.
+CREATE TABLE IF NOT EXISTS job_runs (
+	name   text PRIMARY KEY,
+	ran_at timestamp NOT NULL
+);
+
+-- email_event_daily counts the events of each type per day, kept up to
+-- date by the rollup job.
+CREATE TABLE IF NOT EXISTS email_event_daily (
+	day    date NOT NULL,
+	event  text NOT NULL,
+	events integer NOT NULL,
+	emails integer NOT NULL,
+	PRIMARY KEY (day, event)
+);
@@ -0,0 +1,10 @@
+-- search_ranking holds the ranking weights set through the admin API, one
+-- row shared by every instance. Without it the verticals file's apply.
+CREATE TABLE IF NOT EXISTS search_ranking (
+	id         boolean PRIMARY KEY DEFAULT true CHECK (id),
+	text       double precision NOT NULL,
+	sales      double precision NOT NULL,
+	recency    double precision NOT NULL,
+	expiry     double precision NOT NULL,
+	updated_at timestamp NOT NULL DEFAULT now()
+);
@@ -0,0 +1,4 @@
+-- migrate:no-transaction
+-- only drops the index if the up migration built it
+-- migrate:owns-index email_subscriptions_email
+DROP INDEX CONCURRENTLY IF EXISTS email_subscriptions_email;
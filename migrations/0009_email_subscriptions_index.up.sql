@@ -0,0 +1,9 @@
+-- migrate:no-transaction
+-- email_subscriptions is written by the main application all day, so its
+-- index is built without locking writes out, unless one on email is
+-- there already.
+
+-- every event write looks the subscription up by email
+-- migrate:unless-indexed email_subscriptions (email)
+-- migrate:owns-index email_subscriptions_email
+CREATE INDEX CONCURRENTLY email_subscriptions_email ON email_subscriptions (email);
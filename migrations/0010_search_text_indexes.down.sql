@@ -0,0 +1,8 @@
+-- migrate:no-transaction
+-- only drops the indexes the up migration built
+
+-- migrate:owns-index products_tsv
+DROP INDEX CONCURRENTLY IF EXISTS products_tsv;
+
+-- migrate:owns-index shop_products_tsv
+DROP INDEX CONCURRENTLY IF EXISTS shop_products_tsv;
@@ -0,0 +1,12 @@
+-- migrate:no-transaction
+-- The GIN indexes the suggestion queries match tsv with, built without
+-- locking the main application's writes out, unless one on tsv is there
+-- already or the table does not exist yet.
+
+-- migrate:unless-indexed products (tsv)
+-- migrate:owns-index products_tsv
+CREATE INDEX CONCURRENTLY products_tsv ON products USING gin (tsv);
+
+-- migrate:unless-indexed shop_products (tsv)
+-- migrate:owns-index shop_products_tsv
+CREATE INDEX CONCURRENTLY shop_products_tsv ON shop_products USING gin (tsv);
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/MakeNowJust/heredoc"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	trendingRefreshInterval = 10 * time.Minute
+	trendingWindow          = "24 hours"
+	trendingLimit           = 5
+	recentSearchesLimit     = 5
+)
+
+var (
+	trendingMu sync.RWMutex
+	trending   []string
+)
+
+// refreshTrending keeps the most searched successful terms of the last day
+// in memory; they are the same for everyone, so there is no point in asking
+// the database on every focus of the search box.
+func refreshTrending() {
+	for {
+		terms := []string{}
+		request := heredoc.Docf(`
+			SELECT normalized
+			FROM search_queries
+			WHERE created_at > now() - interval '%s' AND total > 0
+			GROUP BY normalized
+			ORDER BY COUNT(DISTINCT session_id) DESC, COUNT(1) DESC
+			LIMIT %d
+		`, trendingWindow, trendingLimit)
+		if err := searchDB.Select(&terms, request); err != nil {
+			fmt.Println("Unable to compute trending searches:", err)
+		} else {
+			trendingMu.Lock()
+			trending = terms
+			trendingMu.Unlock()
+		}
+		time.Sleep(trendingRefreshInterval)
+	}
+}
+
+func trendingSearches() []string {
+	trendingMu.RLock()
+	defer trendingMu.RUnlock()
+	return trending
+}
+
+// recentSearches lists the latest distinct terms of the caller's session.
+// Callers without a session cookie have no history, and get no cookie
+// either: merely focusing the search box should not start a session.
+func recentSearches(c *gin.Context) (terms []string) {
+	sid, err := c.Cookie(sessionCookie)
+	if err != nil || sid == "" {
+		return
+	}
+	request := heredoc.Doc(`
+		SELECT normalized
+		FROM search_queries
+		WHERE session_id = $1
+		GROUP BY normalized
+		ORDER BY MAX(created_at) DESC
+		LIMIT $2
+	`)
+	if err = dbx.Select(&terms, request, sid, recentSearchesLimit); err != nil {
+		fmt.Println("Unable to load recent searches:", err)
+	}
+	return
+}
+
+// emptyTermSuggestions fills the dropdown before anything is typed: the
+// caller's recent searches, trending searches and the newest items of each
+// vertical.
+func emptyTermSuggestions(ctx context.Context, c *gin.Context, selected Verticals) []SuggestionGroup {
+	groups := []SuggestionGroup{}
+	if g := searchTermsGroup("recent", "Recent searches", recentSearches(c)); len(g.Items) > 0 {
+		groups = append(groups, g)
+	}
+	if g := searchTermsGroup("trending", "Trending searches", trendingSearches()); len(g.Items) > 0 {
+		groups = append(groups, g)
+	}
+
+	for _, v := range selected {
+		total, ids := backend(ctx).SearchIds(ctx, v, "")
+		if total == 0 {
+			continue
+		}
+		group := SuggestionGroup{Vertical: v.Name, Heading: v.Heading, Total: total, Items: []Suggestion{}}
+		for _, x := range backend(ctx).Items(ctx, v, ids) {
+			group.Items = append(group.Items, Suggestion{Href: v.HrefFor(x), Label: html.EscapeString(x.Title)})
+		}
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+func searchTermsGroup(name, heading string, terms []string) SuggestionGroup {
+	group := SuggestionGroup{Vertical: name, Heading: heading, Total: len(terms), Items: []Suggestion{}}
+	for _, term := range terms {
+		group.Items = append(group.Items, Suggestion{Href: "/search?term=" + url.QueryEscape(term), Label: html.EscapeString(term)})
+	}
+	return group
+}
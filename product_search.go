@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MakeNowJust/heredoc"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	sortRelevance  = "relevance"
+	sortNewest     = "newest"
+	sortPopularity = "popularity"
+	sortEndingSoon = "ending_soon"
+
+	defaultSearchPageSize = 20
+	maxSearchPageSize     = 100
+)
+
+// priceFacetBounds are the upper bounds of the price facet buckets; the
+// last bucket is open ended.
+var priceFacetBounds = []int{50, 100, 200, 500, 1000}
+
+// SearchRequest is a parsed GET /search query.
+type SearchRequest struct {
+	Term          string
+	Vertical      *Vertical
+	Sort          string
+	Cursor        *SearchCursor
+	Limit         int
+	CategoryID    int
+	SubCategoryID int
+	PriceMin      float64
+	PriceMax      float64
+	At            time.Time // business wall clock validity is checked at
+}
+
+// SearchCursor is the keyset position after the last hit of a page.
+type SearchCursor struct {
+	Sort    string
+	SortKey float64
+	ID      int
+}
+
+type SearchHit struct {
+	ID     int       `json:"id" db:"id"`
+	Href   string    `json:"href" db:"-"`
+	Label  string    `json:"label" db:"title"`
+	Price  float64   `json:"price" db:"price"`
+	EndsAt time.Time `json:"ends_at" db:"ends_at"`
+
+	SystemName string  `json:"-" db:"system_name"`
+	SaleID     int     `json:"-" db:"sale_id"`
+	SortKey    float64 `json:"-" db:"sort_key"`
+	Total      int     `json:"-" db:"total"`
+}
+
+type SearchFacet struct {
+	Value string `json:"value" db:"value"`
+	Label string `json:"label" db:"label"`
+	Count int    `json:"count" db:"count"`
+}
+
+type SearchFacets struct {
+	Categories []SearchFacet `json:"categories"`
+	Prices     []SearchFacet `json:"prices"`
+}
+
+type SearchResponse struct {
+	Vertical   string       `json:"vertical"`
+	Sort       string       `json:"sort"`
+	Total      int          `json:"total"`
+	Items      []SearchHit  `json:"items"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+	Facets     SearchFacets `json:"facets"`
+}
+
+func processSearch(c *gin.Context) {
+	ctx, ok := searchContext(c)
+	if !ok {
+		return
+	}
+	req, err := parseSearchRequest(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.At = searchTime(ctx)
+
+	res, err := searchProducts(ctx, req)
+	if err != nil {
+		fmt.Println("search error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "search failed"})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func parseSearchRequest(c *gin.Context) (req SearchRequest, err error) {
+	req.Term = strings.TrimSpace(c.Query("term"))
+
+	name := c.Query("vertical")
+	if name == "" {
+		name = verticals[0].Name
+	}
+	selected := verticals.Select(name)
+	if len(selected) != 1 {
+		err = fmt.Errorf("unknown vertical %q", name)
+		return
+	}
+	req.Vertical = selected[0]
+	if req.Vertical.Source == sourceCategories {
+		err = fmt.Errorf("vertical %q lists categories, not products", name)
+		return
+	}
+
+	req.Sort = c.DefaultQuery("sort", sortRelevance)
+	switch req.Sort {
+	case sortRelevance, sortNewest, sortPopularity, sortEndingSoon:
+	default:
+		err = fmt.Errorf("unknown sort %q", req.Sort)
+		return
+	}
+
+	req.Limit = defaultSearchPageSize
+	if s := c.Query("limit"); s != "" {
+		if req.Limit, err = strconv.Atoi(s); err != nil || req.Limit < 1 {
+			err = fmt.Errorf("bad limit %q", s)
+			return
+		}
+		req.Limit = min(req.Limit, maxSearchPageSize)
+	}
+
+	if s := c.Query("cursor"); s != "" {
+		if req.Cursor, err = decodeSearchCursor(s); err != nil || req.Cursor.Sort != req.Sort {
+			err = fmt.Errorf("bad cursor")
+			return
+		}
+	}
+
+	if req.CategoryID, err = queryInt(c, "category"); err != nil {
+		return
+	}
+	if req.SubCategoryID, err = queryInt(c, "sub_category"); err != nil {
+		return
+	}
+	if req.PriceMin, err = queryFloat(c, "price_min"); err != nil {
+		return
+	}
+	if req.PriceMax, err = queryFloat(c, "price_max"); err != nil {
+		return
+	}
+
+	return
+}
+
+func queryInt(c *gin.Context, key string) (n int, err error) {
+	if s := c.Query(key); s != "" {
+		if n, err = strconv.Atoi(s); err != nil {
+			err = fmt.Errorf("bad %s %q", key, s)
+		}
+	}
+	return
+}
+
+func queryFloat(c *gin.Context, key string) (f float64, err error) {
+	if s := c.Query(key); s != "" {
+		if f, err = strconv.ParseFloat(s, 64); err != nil {
+			err = fmt.Errorf("bad %s %q", key, s)
+		}
+	}
+	return
+}
+
+func (sc *SearchCursor) Encode() string {
+	s := fmt.Sprintf("%s|%s|%d", sc.Sort, strconv.FormatFloat(sc.SortKey, 'g', -1, 64), sc.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func decodeSearchCursor(s string) (sc *SearchCursor, err error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return
+	}
+	parts := strings.Split(string(raw), "|")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("bad cursor")
+	}
+	sc = &SearchCursor{Sort: parts[0]}
+	if sc.SortKey, err = strconv.ParseFloat(parts[1], 64); err != nil {
+		return
+	}
+	sc.ID, err = strconv.Atoi(parts[2])
+	return
+}
+
+func searchProducts(ctx context.Context, req SearchRequest) (res SearchResponse, err error) {
+	res = SearchResponse{Vertical: req.Vertical.Name, Sort: req.Sort, Items: []SearchHit{}}
+
+	matches, err := searchMatchesSQL(ctx, req)
+	if err != nil {
+		return
+	}
+	filters := searchFilters(req)
+
+	var sortKey string
+	switch req.Sort {
+	case sortNewest:
+		sortKey = "id::float8"
+	case sortPopularity:
+		sortKey = "sold"
+	case sortEndingSoon:
+		sortKey = "EXTRACT(EPOCH FROM ends_at)::float8"
+	default:
+		sortKey = "pg_search_rank"
+	}
+
+	// ending soon goes up, everything else goes down
+	direction, cmp := "DESC", "<"
+	if req.Sort == sortEndingSoon {
+		direction, cmp = "ASC", ">"
+	}
+	cursorQ := ""
+	if req.Cursor != nil {
+		cursorQ = fmt.Sprintf("WHERE (sort_key, id) %s (%s, %d)",
+			cmp, strconv.FormatFloat(req.Cursor.SortKey, 'g', -1, 64), req.Cursor.ID)
+	}
+
+	request := heredoc.Docf(`
+		%s
+		SELECT id, title, system_name, sale_id, price, ends_at, sort_key, (SELECT COUNT(1) FROM filtered) AS total
+		FROM (SELECT *, %s AS sort_key FROM filtered) sorted
+		%s
+		ORDER BY sort_key %s, id %s
+		LIMIT %d
+	`, filteredSQL(matches, filters, ""), sortKey, cursorQ, direction, direction, req.Limit+1)
+
+	hits := []SearchHit{}
+	if err = selectContext(ctx, searchDB, opSearch, &hits, request); err != nil {
+		return
+	}
+	if len(hits) > req.Limit {
+		last := hits[req.Limit-1]
+		res.NextCursor = (&SearchCursor{Sort: req.Sort, SortKey: last.SortKey, ID: last.ID}).Encode()
+		hits = hits[:req.Limit]
+	}
+	for _, h := range hits {
+		h.Href = req.Vertical.HrefFor(SearchSuggestion{ID: h.ID, Title: h.Label, SystemName: h.SystemName, SaleID: h.SaleID})
+		res.Items = append(res.Items, h)
+	}
+	if len(hits) > 0 {
+		res.Total = hits[0].Total
+	}
+
+	res.Facets, err = searchFacets(ctx, req, matches, filters)
+	return
+}
+
+// searchMatchesSQL is what the id queries of the suggestions match for the
+// vertical of req, ProductSearchIds or ShopProductSearchIds, adults-only
+// items left out.
+func searchMatchesSQL(ctx context.Context, req SearchRequest) (matches string, err error) {
+	v := req.Vertical
+	term := sanitize(req.Term)
+	if v.Source == sourceShopProducts {
+		var ok bool
+		if matches, ok = shopMatchesSQL(ctx, term, whereClause(v.Where)+" "+getAO(ctx, "shop_")); !ok {
+			return "", fmt.Errorf("final sale lookup failed")
+		}
+		return
+	}
+	return couponMatchesSQL(ctx, term, whereClause(v.Where)+" "+getAO(ctx, "")), nil
+}
+
+// searchFilter is a condition on the matches, and the facet it narrows.
+type searchFilter struct {
+	facet string
+	cond  string
+}
+
+const (
+	facetCategories = "categories"
+	facetPrices     = "prices"
+)
+
+func searchFilters(req SearchRequest) (filters []searchFilter) {
+	prefix := ""
+	if req.Vertical.Source == sourceShopProducts {
+		prefix = "shop_"
+	}
+	if req.CategoryID > 0 {
+		filters = append(filters, searchFilter{facetCategories, fmt.Sprintf(`id IN (
+			SELECT psc.product_id FROM "%sproducts_sub_categories" psc
+			JOIN "categories_sub_categories" csc ON csc.sub_category_id = psc.sub_category_id
+			WHERE csc.category_id IN (%s))`, prefix, arrayToString(subtreeIds(req.CategoryID), ","))})
+	}
+	if req.SubCategoryID > 0 {
+		filters = append(filters, searchFilter{facetCategories, fmt.Sprintf(`id IN (
+			SELECT product_id FROM "%sproducts_sub_categories" WHERE sub_category_id = %d)`, prefix, req.SubCategoryID)})
+	}
+	if req.PriceMin > 0 {
+		filters = append(filters, searchFilter{facetPrices, "price >= " + strconv.FormatFloat(req.PriceMin, 'f', -1, 64)})
+	}
+	if req.PriceMax > 0 {
+		filters = append(filters, searchFilter{facetPrices, "price <= " + strconv.FormatFloat(req.PriceMax, 'f', -1, 64)})
+	}
+	return
+}
+
+// filteredSQL builds the "matches" and "filtered" CTEs, filtered applying
+// every filter but those of the facet except, so a facet counts what
+// picking one of its other values would find.
+func filteredSQL(matches string, filters []searchFilter, except string) string {
+	var conds []string
+	for _, f := range filters {
+		if f.facet != except {
+			conds = append(conds, f.cond)
+		}
+	}
+	where := ""
+	if len(conds) > 0 {
+		where = "WHERE " + strings.Join(conds, " AND ")
+	}
+	return heredoc.Docf(`
+		WITH matches AS (
+		%s
+		),
+		filtered AS (
+			SELECT * FROM matches %s
+		)
+	`, matches, where)
+}
+
+func searchFacets(ctx context.Context, req SearchRequest, matches string, filters []searchFilter) (facets SearchFacets, err error) {
+	facets = SearchFacets{Categories: []SearchFacet{}, Prices: []SearchFacet{}}
+
+	prefix := ""
+	if req.Vertical.Source == sourceShopProducts {
+		prefix = "shop_"
+	}
+	request := heredoc.Docf(`
+		%s
+		SELECT categories.id::text AS value, COALESCE(NULLIF(categories.name, ''), categories.system_name) AS label,
+			COUNT(DISTINCT filtered.id) AS count
+		FROM filtered
+		JOIN "%sproducts_sub_categories" psc ON psc.product_id = filtered.id
+		JOIN "categories_sub_categories" csc ON csc.sub_category_id = psc.sub_category_id
+		JOIN "categories" ON categories.id = csc.category_id AND categories.is_active = true
+		GROUP BY categories.id, categories.name, categories.system_name
+		ORDER BY count DESC
+	`, filteredSQL(matches, filters, facetCategories), prefix)
+	if err = selectContext(ctx, searchDB, opSearch, &facets.Categories, request); err != nil {
+		return
+	}
+
+	var (
+		cases []string
+		lower int
+	)
+	for _, upper := range priceFacetBounds {
+		cases = append(cases, fmt.Sprintf("WHEN price < %d THEN '%d-%d'", upper, lower, upper))
+		lower = upper
+	}
+	request = heredoc.Docf(`
+		%s
+		SELECT bucket AS value, bucket AS label, COUNT(1) AS count
+		FROM (SELECT CASE %s ELSE '%d+' END AS bucket, price FROM filtered) b
+		GROUP BY bucket
+		ORDER BY MIN(price)
+	`, filteredSQL(matches, filters, facetPrices), strings.Join(cases, " "), lower)
+	err = selectContext(ctx, searchDB, opSearch, &facets.Prices, request)
+	return
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCategoryFilterCoversSubtree(t *testing.T) {
+	saved := currentCategoryTree()
+	t.Cleanup(func() { categoryTree = saved })
+
+	root, child, grandchild, other := &Category{ID: 1}, &Category{ID: 2}, &Category{ID: 3}, &Category{ID: 4}
+	root.children = []*Category{child}
+	child.children = []*Category{grandchild}
+	categoryTree = &CategoryTree{categories: map[int]*Category{1: root, 2: child, 3: grandchild, 4: other}}
+
+	tests := []struct {
+		category int
+		want     string
+	}{
+		{1, "csc.category_id IN (1,2,3)"},
+		{2, "csc.category_id IN (2,3)"},
+		{4, "csc.category_id IN (4)"},
+		{9, "csc.category_id IN (9)"}, // not in the tree yet
+	}
+	for _, tt := range tests {
+		filters := searchFilters(SearchRequest{Vertical: &Vertical{Source: sourceProducts}, CategoryID: tt.category})
+		if len(filters) != 1 || !strings.Contains(filters[0].cond, tt.want) {
+			t.Errorf("category %d: filters %v, want one with %q", tt.category, filters, tt.want)
+		}
+	}
+}
+
+func TestSeeAllHrefsParse(t *testing.T) {
+	cfg, err := parseSearchConfig([]byte(defaultVerticals))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := verticals
+	t.Cleanup(func() { verticals = saved })
+	verticals = cfg.Verticals
+
+	gin.SetMode(gin.TestMode)
+	for _, v := range verticals {
+		seeAll, ok := v.SeeAllFor("spa & more", 10)
+		if !ok {
+			if v.Source != sourceCategories {
+				t.Errorf("%s: no see-all link", v.Name)
+			}
+			continue
+		}
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", seeAll.Href, nil)
+		req, err := parseSearchRequest(c)
+		if err != nil {
+			t.Errorf("%s: see all %s: %v", v.Name, seeAll.Href, err)
+		} else if req.Vertical != v || req.Term != "spa & more" {
+			t.Errorf("%s: see all %s parses to vertical %s, term %q", v.Name, seeAll.Href, req.Vertical.Name, req.Term)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/yvasiyarov/go-metrics"
+)
+
+// Query operations, each with its own deadline from config.QueryTimeouts.
+const (
+	opSearch  = "search"  // the id lookups of a vertical
+	opHydrate = "hydrate" // filter*, getAO and the other lookups around them
+	opEvents  = "events"  // SendGrid event writes
+)
+
+const queryCancelTimeout = 5 * time.Second
+
+// queryTimeouts counts, per operation, the queries that ran past their
+// deadline. They are reported to New Relic as db/timeouts/<op>.
+var queryTimeouts = map[string]metrics.Counter{
+	opSearch:  metrics.NewCounter(),
+	opHydrate: metrics.NewCounter(),
+	opEvents:  metrics.NewCounter(),
+}
+
+func queryTimeout(op string) time.Duration {
+	switch op {
+	case opSearch:
+		return config.QueryTimeouts.Search
+	case opHydrate:
+		return config.QueryTimeouts.Hydrate
+	case opEvents:
+		return config.QueryTimeouts.Events
+	}
+	return 0
+}
+
+// selectContext is db.Select bounded by ctx and the deadline of op. The
+// vendored lib/pq predates contexts, so a query outliving ctx is cancelled
+// on the server with pg_cancel_backend.
+func selectContext(ctx context.Context, db *sqlx.DB, op string, dest interface{}, query string, args ...interface{}) error {
+	return withQueryContext(ctx, db, op, func(ctx context.Context, conn *sql.Conn) error {
+		return sqlx.Select(connQueryer{ctx, conn, db}, dest, query, args...)
+	})
+}
+
+// execContext is db.Exec bounded like selectContext.
+func execContext(ctx context.Context, db *sqlx.DB, op string, query string, args ...interface{}) (result sql.Result, err error) {
+	err = withQueryContext(ctx, db, op, func(ctx context.Context, conn *sql.Conn) (err error) {
+		result, err = conn.ExecContext(ctx, query, args...)
+		return
+	})
+	return
+}
+
+func withQueryContext(ctx context.Context, db *sqlx.DB, op string, run func(context.Context, *sql.Conn) error) error {
+	if timeout := queryTimeout(op); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return countTimeout(ctx, op, err)
+	}
+	defer conn.Close()
+	pid, err := backendPID(ctx, conn)
+	if err != nil {
+		return countTimeout(ctx, op, err)
+	}
+
+	// The watcher is waited for before conn goes back to the pool, so a
+	// late cancel cannot hit the next query run on it.
+	done, watched := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(watched)
+		select {
+		case <-ctx.Done():
+			cancelCtx, cancel := context.WithTimeout(context.Background(), queryCancelTimeout)
+			defer cancel()
+			if _, err := cancelDB(db).ExecContext(cancelCtx, `SELECT pg_cancel_backend($1)`, pid); err != nil {
+				fmt.Println("Unable to cancel query:", err)
+			}
+		case <-done:
+		}
+	}()
+	err = run(ctx, conn)
+	close(done)
+	<-watched
+	return countTimeout(ctx, op, err)
+}
+
+// cancelDBs holds, per pool, the separate connection pg_cancel_backend is
+// sent on: stuck queries may hold every connection of their own pool, and
+// a cancel queued behind them would never run. openDB sets them up before
+// any query.
+var cancelDBs = map[*sqlx.DB]*sql.DB{}
+
+func openCancelDB(pool *sqlx.DB, dsn string) error {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return err
+	}
+	db.SetMaxOpenConns(2)
+	db.SetMaxIdleConns(1)
+	db.SetConnMaxLifetime(config.DBConnMaxLifetime)
+	cancelDBs[pool] = db
+	return nil
+}
+
+// cancelDB is the connection to cancel the queries of pool on, the pool
+// itself for one openDB did not open, as in tests.
+func cancelDB(pool *sqlx.DB) *sql.DB {
+	if db, ok := cancelDBs[pool]; ok {
+		return db
+	}
+	return pool.DB
+}
+
+// backendPIDs caches the server process of each driver connection. It is
+// emptied once it outgrows the pools, connections being recycled.
+var (
+	backendPIDsMu sync.Mutex
+	backendPIDs   = map[driver.Conn]int{}
+)
+
+func backendPID(ctx context.Context, conn *sql.Conn) (pid int, err error) {
+	var key driver.Conn
+	conn.Raw(func(dc interface{}) error {
+		key, _ = dc.(driver.Conn)
+		return nil
+	})
+	backendPIDsMu.Lock()
+	pid, ok := backendPIDs[key]
+	backendPIDsMu.Unlock()
+	if ok {
+		return pid, nil
+	}
+	if err = conn.QueryRowContext(ctx, `SELECT pg_backend_pid()`).Scan(&pid); err != nil {
+		return
+	}
+	backendPIDsMu.Lock()
+	if len(backendPIDs) >= 4*config.DBPoolSize {
+		backendPIDs = map[driver.Conn]int{}
+	}
+	backendPIDs[key] = pid
+	backendPIDsMu.Unlock()
+	return
+}
+
+// countTimeout counts err against op when it comes from a deadline: ours,
+// or the server's statement_timeout. A request the client gave up on is
+// not a timeout.
+func countTimeout(ctx context.Context, op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	timedOut := ctx.Err() == context.DeadlineExceeded
+	if ctx.Err() == nil && isQueryTimeout(err) {
+		timedOut = true // statement_timeout
+	}
+	if timedOut {
+		queryTimeouts[op].Inc(1)
+		if tally, ok := ctx.Value(queryTimeoutTally{}).(*int32); ok {
+			atomic.AddInt32(tally, 1)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// isQueryTimeout tells whether err is a deadline, ours or the server's
+// statement_timeout (query_canceled).
+func isQueryTimeout(err error) bool {
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "57014"
+}
+
+type queryTimeoutTally struct{}
+
+// trackQueryTimeouts returns a ctx whose timed-out queries are tallied in
+// the returned count.
+func trackQueryTimeouts(ctx context.Context) (context.Context, *int32) {
+	tally := new(int32)
+	return context.WithValue(ctx, queryTimeoutTally{}, tally), tally
+}
+
+// connQueryer runs sqlx helpers on a single connection under ctx.
+type connQueryer struct {
+	ctx  context.Context
+	conn *sql.Conn
+	db   *sqlx.DB
+}
+
+func (q connQueryer) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return q.conn.QueryContext(q.ctx, query, args...)
+}
+
+func (q connQueryer) Queryx(query string, args ...interface{}) (*sqlx.Rows, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlx.Rows{Rows: rows, Mapper: q.db.Mapper}, nil
+}
+
+// QueryRowx only completes sqlx.Queryer: a sqlx.Row cannot be built outside
+// sqlx, so it runs on the pool without ctx. selectContext never calls it.
+func (q connQueryer) QueryRowx(query string, args ...interface{}) *sqlx.Row {
+	return q.db.QueryRowx(query, args...)
+}
+
+// queryTimeoutMetrica reports a queryTimeouts counter per harvest.
+type queryTimeoutMetrica struct {
+	op string
+}
+
+func (m queryTimeoutMetrica) GetName() string  { return "db/timeouts/" + m.op }
+func (m queryTimeoutMetrica) GetUnits() string { return "count" }
+
+func (m queryTimeoutMetrica) GetValue() (float64, error) {
+	counter := queryTimeouts[m.op]
+	n := counter.Count()
+	counter.Dec(n)
+	return float64(n), nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/MakeNowJust/heredoc"
+	"github.com/lib/pq"
+	"github.com/yvasiyarov/go-metrics"
+)
+
+const (
+	eventJobLease         = 5 * time.Minute // a claimed job is retried after this if its worker died
+	eventJobBackoff       = 30 * time.Second
+	eventJobMaxBackoff    = time.Hour
+	singletonJobsInterval = time.Minute
+	rollupInterval        = time.Hour
+)
+
+// eventJob is a queued SendGrid event, its payload as received.
+type eventJob struct {
+	ID       int64  `db:"id"`
+	Payload  string `db:"payload"`
+	Attempts int    `db:"attempts"`
+}
+
+// eventJobsQueued wakes a worker of this instance as soon as it queues
+// events, rather than at its next poll.
+var eventJobsQueued = make(chan struct{}, 1)
+
+// invalidEvents counts the posted events dropped by validation, reported to
+// New Relic as webhook/invalid.
+var invalidEvents = metrics.NewCounter()
+
+// enqueueEvents stores the valid events in event_jobs for the workers of
+// any instance. Once it returns they are safe from a crash.
+func enqueueEvents(ctx context.Context, events Events) error {
+	request, args, invalid := enqueueRequest(events)
+	if len(invalid) > 0 {
+		invalidEvents.Inc(int64(len(invalid)))
+		fmt.Printf("Skipping %d invalid events, the first: %v\n", len(invalid), invalid[0])
+	}
+	if request == "" {
+		return nil
+	}
+	if _, err := execContext(ctx, dbx, opEvents, request, args...); err != nil {
+		return err
+	}
+	select {
+	case eventJobsQueued <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// enqueueRequest is the INSERT of the valid events, empty when there are
+// none. The payloads go as a single array parameter, as a batch may hold
+// more events than a statement takes parameters.
+func enqueueRequest(events Events) (request string, args []interface{}, invalid []error) {
+	var payloads []string
+	for _, event := range events {
+		if err := event.validate(); err != nil {
+			invalid = append(invalid, err)
+			continue
+		}
+		payloads = append(payloads, string(event.payload()))
+	}
+	if len(payloads) == 0 {
+		return
+	}
+	return `INSERT INTO event_jobs (payload) SELECT unnest($1::jsonb[])`, []interface{}{pq.Array(payloads)}, invalid
+}
+
+// invalidEventsMetrica reports invalidEvents per harvest.
+type invalidEventsMetrica struct{}
+
+func (invalidEventsMetrica) GetName() string  { return "webhook/invalid" }
+func (invalidEventsMetrica) GetUnits() string { return "events" }
+
+func (invalidEventsMetrica) GetValue() (float64, error) {
+	n := invalidEvents.Count()
+	invalidEvents.Dec(n)
+	return float64(n), nil
+}
+
+func startEventWorkers(n int) {
+	for i := 0; i < n; i++ {
+		go eventWorker()
+	}
+}
+
+// eventWorker claims batches of due jobs until the queue runs dry, then
+// waits for the next poll or for this instance to queue more.
+func eventWorker() {
+	ctx := context.Background()
+	poll := time.NewTicker(config.Events.PollInterval)
+	for {
+		jobs, err := claimEventJobs(ctx, config.Events.BatchSize)
+		if err != nil {
+			fmt.Println("Unable to claim event jobs:", err)
+		}
+		for _, job := range jobs {
+			runEventJob(ctx, job)
+		}
+		if len(jobs) == config.Events.BatchSize {
+			continue
+		}
+		select {
+		case <-poll.C:
+		case <-eventJobsQueued:
+		}
+	}
+}
+
+// claimEventJobs leases up to limit due jobs. SKIP LOCKED lets the workers
+// of every instance claim side by side, each getting different jobs.
+func claimEventJobs(ctx context.Context, limit int) (jobs []eventJob, err error) {
+	jobs = []eventJob{}
+	request := heredoc.Docf(`
+		UPDATE event_jobs SET locked_until = now() + interval '%d seconds', attempts = attempts + 1
+		WHERE id IN (
+			SELECT id FROM event_jobs
+			WHERE run_at <= now() AND (locked_until IS NULL OR locked_until < now())
+			ORDER BY run_at, id
+			LIMIT %d
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, payload, attempts
+	`, int(eventJobLease/time.Second), limit)
+	err = selectContext(ctx, dbx, opEvents, &jobs, request)
+	return
+}
+
+// runEventJob writes the event of job and drops the job. A failed write is
+// retried with a growing delay, then dead-lettered after
+// EVENT_MAX_ATTEMPTS; an event that cannot be valid is dropped at once.
+func runEventJob(ctx context.Context, job eventJob) {
+	event, err := decodeEvent([]byte(job.Payload))
+	if err == nil {
+		err = event.validate()
+	}
+	if err != nil {
+		fmt.Println("Skipping invalid event:", err)
+		finishEventJob(ctx, job)
+		return
+	}
+
+	if _, err = writeEvent(ctx, event); err == nil {
+		finishEventJob(ctx, job)
+		return
+	}
+	if job.Attempts >= config.Events.MaxAttempts {
+		fmt.Printf("Unable to register %s event after %d attempts, dead-lettered: %v\n", event.Event, job.Attempts, err)
+		deadLetter(ctx, event, err)
+		finishEventJob(ctx, job)
+		return
+	}
+
+	backoff := eventJobBackoff << uint(job.Attempts-1)
+	if backoff <= 0 || backoff > eventJobMaxBackoff {
+		backoff = eventJobMaxBackoff
+	}
+	request := heredoc.Docf(`
+		UPDATE event_jobs SET run_at = now() + interval '%d seconds', locked_until = NULL, last_error = $2
+		WHERE id = $1
+	`, int(backoff/time.Second))
+	if _, updateErr := execContext(ctx, dbx, opEvents, request, job.ID, err.Error()); updateErr != nil {
+		fmt.Printf("Unable to reschedule event job %d: %v\n", job.ID, updateErr)
+	}
+}
+
+func finishEventJob(ctx context.Context, job eventJob) {
+	if _, err := execContext(ctx, dbx, opEvents, `DELETE FROM event_jobs WHERE id = $1`, job.ID); err != nil {
+		fmt.Printf("Unable to finish event job %d: %v\n", job.ID, err)
+	}
+}
+
+// singletonJob is periodic work only one instance may do at a time. Every
+// instance checks once a minute; the one getting the advisory lock runs
+// the job if job_runs says it is due.
+type singletonJob struct {
+	name    string
+	lockKey int64
+	every   time.Duration
+	run     func() error
+}
+
+var singletonJobs = []singletonJob{
+	{"email_event_rollup", 20490001, rollupInterval, rollupEmailEvents},
+	{"email_event_retention", 20490002, 24 * time.Hour, expireEmailEvents},
+}
+
+func startSingletonJobs() {
+	for _, job := range singletonJobs {
+		go func(job singletonJob) {
+			for range time.Tick(singletonJobsInterval) {
+				if err := job.runIfDue(); err != nil {
+					fmt.Printf("Singleton job %s failed: %v\n", job.name, err)
+				}
+			}
+		}(job)
+	}
+}
+
+func (job singletonJob) runIfDue() error {
+	ctx := context.Background()
+	conn, err := dbx.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err = conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, job.lockKey).Scan(&locked); err != nil || !locked {
+		return err // another instance has it
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, job.lockKey)
+
+	var due bool
+	request := heredoc.Docf(`
+		SELECT NOT EXISTS (SELECT 1 FROM job_runs WHERE name = $1 AND ran_at > now() - interval '%d seconds')
+	`, int(job.every/time.Second))
+	if err = conn.QueryRowContext(ctx, request, job.name).Scan(&due); err != nil || !due {
+		return err
+	}
+	if err = job.run(); err != nil {
+		return err
+	}
+	request = heredoc.Doc(`
+		INSERT INTO job_runs (name, ran_at) VALUES ($1, now())
+		ON CONFLICT (name) DO UPDATE SET ran_at = now()
+	`)
+	_, err = conn.ExecContext(ctx, request, job.name)
+	return err
+}
+
+// rollupEmailEvents recounts email_event_daily for every day that received
+// events since the previous rollup, backfilled ones included.
+func rollupEmailEvents() error {
+	request := heredoc.Docf(`
+		INSERT INTO email_event_daily (day, event, events, emails)
+		SELECT happened_at::date, event, COUNT(1), COUNT(DISTINCT email)
+		FROM email_events
+		WHERE happened_at::date IN (
+			SELECT DISTINCT happened_at::date FROM email_events WHERE created_at > now() - interval '%d seconds'
+		)
+		GROUP BY 1, 2
+		ON CONFLICT (day, event) DO UPDATE SET events = EXCLUDED.events, emails = EXCLUDED.emails
+	`, int(2*rollupInterval/time.Second))
+	_, err := dbx.Exec(request)
+	return err
+}
+
+// expireEmailEvents deletes the events older than EVENT_RETENTION. Their
+// daily counts stay.
+func expireEmailEvents() error {
+	if config.Events.Retention <= 0 {
+		return nil
+	}
+	request := fmt.Sprintf(`DELETE FROM email_events WHERE happened_at < now() - interval '%d seconds'`,
+		int64(config.Events.Retention/time.Second))
+	_, err := dbx.Exec(request)
+	return err
+}
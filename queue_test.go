@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+// maxParams is the most parameters Postgres takes in one statement.
+const maxParams = 65535
+
+func manyEvents(n int) (events Events) {
+	for i := 0; i < n; i++ {
+		events = append(events, Event{Email: "a@x.com", Event: "open", Timestamp: int64(i + 1)})
+	}
+	return
+}
+
+func TestEnqueueRequest(t *testing.T) {
+	events := append(manyEvents(maxParams+1), Event{Event: "open", Timestamp: 1}, Event{Email: "a@x.com", Event: "open"})
+	request, args, invalid := enqueueRequest(events)
+	if request == "" || len(args) != 1 {
+		t.Fatalf("%d parameters for %d events, want them in one", len(args), len(events))
+	}
+	if payloads := *args[0].(*pq.StringArray); len(payloads) != maxParams+1 {
+		t.Errorf("%d payloads, want the %d valid events", len(payloads), maxParams+1)
+	}
+	if len(invalid) != 2 {
+		t.Errorf("%d invalid events, want 2", len(invalid))
+	}
+
+	if request, _, invalid = enqueueRequest(events[maxParams+1:]); request != "" || len(invalid) != 2 {
+		t.Errorf("only invalid events: request %q, %d invalid; want none and 2", request, len(invalid))
+	}
+}
+
+func TestPostgresEnqueueEvents(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	conn := openTestSchema(t, url)
+	defer conn.Close()
+	schema, err := migrationFiles.ReadFile("migrations/0007_event_queue.up.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Exec(string(schema)); err != nil {
+		t.Fatal(err)
+	}
+	saved := dbx
+	dbx = conn
+	defer func() { dbx = saved }()
+
+	if err = enqueueEvents(context.Background(), manyEvents(maxParams+1)); err != nil {
+		t.Fatal(err)
+	}
+	var queued int
+	if err = conn.Get(&queued, `SELECT COUNT(1) FROM event_jobs`); err != nil {
+		t.Fatal(err)
+	}
+	if queued != maxParams+1 {
+		t.Errorf("%d events queued, want %d", queued, maxParams+1)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/MakeNowJust/heredoc"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v2"
+)
+
+// RankingWeights blend the signals a suggestion is ranked by. Sales and
+// recency are scaled to 0..1 before weighting; a positive Expiry promotes
+// items that are about to end, a negative one buries them.
+type RankingWeights struct {
+	Text    float64 `yaml:"text" json:"text" db:"text"`
+	Sales   float64 `yaml:"sales" json:"sales" db:"sales"`
+	Recency float64 `yaml:"recency" json:"recency" db:"recency"`
+	Expiry  float64 `yaml:"expiry" json:"expiry" db:"expiry"`
+}
+
+var defaultRanking = RankingWeights{Text: 1, Sales: 0.3, Recency: 0.2, Expiry: 0.1}
+
+// textOnlyRanking is the historical ts_rank-only ordering.
+var textOnlyRanking = RankingWeights{Text: 1}
+
+const rankingRefreshInterval = time.Minute
+
+var (
+	rankingMu sync.RWMutex
+	ranking   = defaultRanking
+
+	// configuredRanking is the ranking of the verticals file, in force
+	// until weights are stored in search_ranking.
+	configuredRanking = defaultRanking
+)
+
+func currentRanking() RankingWeights {
+	rankingMu.RLock()
+	defer rankingMu.RUnlock()
+	return ranking
+}
+
+func setRanking(w RankingWeights) {
+	rankingMu.Lock()
+	ranking = w
+	rankingMu.Unlock()
+}
+
+func (w RankingWeights) validate() error {
+	for _, f := range []float64{w.Text, w.Sales, w.Recency, w.Expiry} {
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return fmt.Errorf("ranking: weights must be finite numbers")
+		}
+	}
+	if w.Text <= 0 {
+		return fmt.Errorf("ranking: text weight must be positive")
+	}
+	return nil
+}
+
+// rankingSQL is the score expression at now over the given column
+// expressions: the text rank, units sold, and when the item started and ends.
+//
+//	sales:   ln(1 + sold) / ln(1001), capped at 1
+//	recency: halves every 14 days since start
+//	expiry:  halves every 3 days closer to the end
+func rankingSQL(w RankingWeights, now, textRank, sold, startsAt, endsAt string) string {
+	return fmt.Sprintf(`(%s * %s + %s * LEAST(ln(1 + GREATEST(COALESCE(%s, 0), 0)) / ln(1001), 1) + `+
+		`%s * power(0.5, GREATEST(EXTRACT(EPOCH FROM %s - %s), 0) / 1209600) + `+
+		`%s * power(0.5, GREATEST(EXTRACT(EPOCH FROM %s - %s), 0) / 259200))`,
+		formatFloat(w.Text), textRank, formatFloat(w.Sales), sold,
+		formatFloat(w.Recency), now, startsAt, formatFloat(w.Expiry), endsAt, now)
+}
+
+// rankingScore is rankingSQL computed in Go, for the in-memory index.
+func rankingScore(w RankingWeights, textRank, sold float64, startsAt, endsAt, now time.Time) float64 {
+	return w.Text*textRank +
+		w.Sales*math.Min(math.Log(1+math.Max(sold, 0))/math.Log(1001), 1) +
+		w.Recency*math.Pow(0.5, math.Max(now.Sub(startsAt).Seconds(), 0)/1209600) +
+		w.Expiry*math.Pow(0.5, math.Max(endsAt.Sub(now).Seconds(), 0)/259200)
+}
+
+func getRanking(c *gin.Context) {
+	c.JSON(http.StatusOK, currentRanking())
+}
+
+func prepareRanking() {
+	loadRanking()
+
+	go func() {
+		for range time.Tick(rankingRefreshInterval) {
+			loadRanking()
+		}
+	}()
+}
+
+// loadRanking applies the weights stored in search_ranking, or those of
+// the verticals file when none are. A change purges the suggestion cache,
+// so the instances that did not take the PUT catch up within
+// rankingRefreshInterval.
+func loadRanking() {
+	stored := []RankingWeights{}
+	if err := dbx.Select(&stored, `SELECT text, sales, recency, expiry FROM search_ranking`); err != nil {
+		fmt.Println("Unable to load ranking:", err)
+		return
+	}
+	w := configuredRanking
+	if len(stored) > 0 {
+		w = stored[0]
+	}
+	if w != currentRanking() {
+		setRanking(w)
+		suggestionCache.Purge()
+	}
+}
+
+// putRanking stores new weights for every instance.
+func putRanking(c *gin.Context) {
+	w := currentRanking()
+	if err := c.ShouldBindJSON(&w); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := w.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	request := heredoc.Doc(`
+		INSERT INTO search_ranking (text, sales, recency, expiry) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (id) DO UPDATE SET text = EXCLUDED.text, sales = EXCLUDED.sales,
+			recency = EXCLUDED.recency, expiry = EXCLUDED.expiry, updated_at = now()
+	`)
+	if _, err := dbx.Exec(request, w.Text, w.Sales, w.Recency, w.Expiry); err != nil {
+		fmt.Println("put ranking error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to save ranking"})
+		return
+	}
+	setRanking(w)
+	suggestionCache.Purge()
+	c.JSON(http.StatusOK, w)
+}
+
+// LabelledQuery is a search term with the ids a merchandiser considers
+// good results, graded 1 (fine) to 3 (perfect).
+type LabelledQuery struct {
+	Term     string      `yaml:"term"`
+	Vertical string      `yaml:"vertical"`
+	Relevant map[int]int `yaml:"relevant"`
+}
+
+// evaluateRanking replays a labelled query set with the text-only ordering
+// and the configured weights and prints NDCG for both.
+func evaluateRanking(w io.Writer, path string) (err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	var set struct {
+		Queries []LabelledQuery `yaml:"queries"`
+	}
+	if err = yaml.Unmarshal(data, &set); err != nil {
+		return
+	}
+
+	ctx := context.Background()
+	weights := currentRanking()
+	defer setRanking(weights)
+
+	var baseSum, weightedSum float64
+	fmt.Fprintf(w, "%-30s %-10s %8s %8s\n", "term", "vertical", "text", "weighted")
+	for _, q := range set.Queries {
+		selected := verticals.Select(q.Vertical)
+		if len(selected) != 1 {
+			return fmt.Errorf("query %q: unknown vertical %q", q.Term, q.Vertical)
+		}
+		v := selected[0]
+
+		setRanking(textOnlyRanking)
+		_, baseIds := backend(ctx).SearchIds(ctx, v, q.Term)
+		setRanking(weights)
+		_, weightedIds := backend(ctx).SearchIds(ctx, v, q.Term)
+
+		base, weighted := ndcg(baseIds, q.Relevant, v.Limit), ndcg(weightedIds, q.Relevant, v.Limit)
+		baseSum += base
+		weightedSum += weighted
+		fmt.Fprintf(w, "%-30s %-10s %8.3f %8.3f\n", q.Term, v.Name, base, weighted)
+	}
+	if n := float64(len(set.Queries)); n > 0 {
+		fmt.Fprintf(w, "%-30s %-10s %8.3f %8.3f\n", "mean NDCG", "", baseSum/n, weightedSum/n)
+	}
+	return
+}
+
+// ndcg is the normalized discounted cumulative gain of ids at k.
+func ndcg(ids []int, grades map[int]int, k int) float64 {
+	dcg := func(gains []int) (sum float64) {
+		for i, g := range gains {
+			if k > 0 && i >= k {
+				break
+			}
+			sum += (math.Pow(2, float64(g)) - 1) / math.Log2(float64(i+2))
+		}
+		return
+	}
+
+	var got, ideal []int
+	for _, id := range ids {
+		got = append(got, grades[id])
+	}
+	for _, g := range grades {
+		ideal = append(ideal, g)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(ideal)))
+
+	best := dcg(ideal)
+	if best == 0 {
+		return 0
+	}
+	return dcg(got) / best
+}
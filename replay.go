@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// readEvents decodes saved SendGrid payloads: any sequence of JSON arrays,
+// as posted to /api/sendgrid_event, and single events, which covers
+// NDJSON and "export" output alike. A value that is not JSON is handed to
+// malformed and reading resumes on the next line; so is an event of an
+// array that does not decode, the others going on.
+func readEvents(r io.Reader, each func(Event) error, malformed func(error)) error {
+	input := bufio.NewReader(r)
+	decoder := json.NewDecoder(input)
+	for n := 1; ; n++ {
+		var raw json.RawMessage
+		err := decoder.Decode(&raw)
+		if err == io.EOF {
+			return nil
+		}
+		var syntax *json.SyntaxError
+		if err != nil && !errors.As(err, &syntax) && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("value %d: %v", n, err)
+		}
+		if err != nil {
+			malformed(fmt.Errorf("value %d: %v", n, err))
+			input = bufio.NewReader(io.MultiReader(decoder.Buffered(), input))
+			if err = skipLine(input); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			decoder = json.NewDecoder(input)
+			continue
+		}
+
+		raws, array := []json.RawMessage{raw}, raw[0] == '['
+		if array {
+			if err = json.Unmarshal(raw, &raws); err != nil {
+				malformed(fmt.Errorf("value %d: %v", n, err))
+				continue
+			}
+		}
+		for i, raw := range raws {
+			event, err := decodeEvent(raw)
+			if err != nil {
+				if array {
+					err = fmt.Errorf("event %d: %v", i, err)
+				}
+				malformed(fmt.Errorf("value %d: %v", n, err))
+				continue
+			}
+			if err = each(event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// skipLine drops input up to the end of the line the next value starts on.
+func skipLine(input *bufio.Reader) error {
+	for {
+		b, err := input.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			break
+		}
+	}
+	_, err := input.ReadString('\n')
+	return err
+}
+
+// csvEventColumns maps the headers of SendGrid's activity CSV exports,
+// lowercased, to event fields; unknown columns are kept in the payload only.
+var csvEventColumns = map[string]string{
+	"email":           "email",
+	"event":           "event",
+	"timestamp":       "timestamp",
+	"processed":       "timestamp",
+	"time":            "timestamp",
+	"url":             "url",
+	"category":        "category",
+	"categories":      "category",
+	"sg_event_id":     "sg_event_id",
+	"sg_message_id":   "sg_message_id",
+	"message_id":      "sg_message_id",
+	"smtp-id":         "smtp-id",
+	"ip":              "ip",
+	"originating_ip":  "ip",
+	"useragent":       "useragent",
+	"http_user_agent": "useragent",
+}
+
+// csvTimeLayouts are the timestamp forms seen in exports besides Unix
+// seconds, all UTC.
+var csvTimeLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04:05.000"}
+
+// readCSVEvents decodes a SendGrid CSV export. The header row names the
+// columns; email, event and a timestamp are required. A row that does not
+// parse is handed to malformed, with the line it starts on, and skipped.
+func readCSVEvents(r io.Reader, each func(Event) error, malformed func(error)) error {
+	table := csv.NewReader(bufio.NewReader(r))
+	table.FieldsPerRecord = -1
+	header, err := table.Read()
+	if err != nil {
+		return fmt.Errorf("header: %v", err)
+	}
+	fields := make([]string, len(header))
+	found := map[string]bool{}
+	for i, h := range header {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if f, ok := csvEventColumns[h]; ok && !found[f] {
+			fields[i], found[f] = f, true
+		}
+	}
+	for _, required := range []string{"email", "event", "timestamp"} {
+		if !found[required] {
+			return fmt.Errorf("header: no %s column among %q", required, header)
+		}
+	}
+
+	for {
+		record, err := table.Read()
+		var parse *csv.ParseError
+		if err == io.EOF {
+			return nil
+		} else if errors.As(err, &parse) {
+			malformed(err)
+			continue
+		} else if err != nil {
+			return err
+		}
+		line, _ := table.FieldPos(0) // quoted fields may span lines
+
+		payload := map[string]interface{}{}
+		for i, value := range record {
+			if i >= len(header) || value == "" {
+				continue
+			}
+			key := fields[i]
+			if key == "" {
+				key = strings.TrimSpace(header[i])
+			}
+			payload[key] = value
+		}
+		if s, ok := payload["timestamp"].(string); ok {
+			ts, err := parseCSVTimestamp(s)
+			if err != nil {
+				malformed(fmt.Errorf("line %d: %v", line, err))
+				continue
+			}
+			payload["timestamp"] = ts
+		}
+		raw, _ := json.Marshal(payload)
+		event, err := decodeEvent(raw)
+		if err != nil {
+			malformed(fmt.Errorf("line %d: %v", line, err))
+			continue
+		}
+		if err = each(event); err != nil {
+			return err
+		}
+	}
+}
+
+func parseCSVTimestamp(s string) (int64, error) {
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return ts, nil
+	}
+	for _, layout := range csvTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.Unix(), nil
+		}
+	}
+	return 0, fmt.Errorf("bad timestamp %q, want Unix seconds or RFC 3339", s)
+}
+
+// eventRecorded tells whether an event with sgEventID is in email_events,
+// never for an empty id: those cannot be told apart.
+func eventRecorded(ctx context.Context, sgEventID string) (recorded bool, err error) {
+	if sgEventID == "" {
+		return false, nil
+	}
+	var found []int
+	err = selectContext(ctx, dbx, opEvents, &found, `SELECT 1 FROM email_events WHERE sg_event_id = $1`, sgEventID)
+	return len(found) > 0, err
+}
+
+// replayProgress counts the outcomes of a replay and reports them.
+type replayProgress struct {
+	started   time.Time
+	dryRun    bool
+	counts    map[ingestOutcome]int
+	total     int
+	malformed int // records that did not decode to an event
+	unkeyed   int // written events without sg_event_id, which no dedupe catches
+}
+
+func (p *replayProgress) report(w io.Writer, final bool) {
+	state, written := "progress", "written"
+	if final {
+		state = "done"
+	}
+	if p.dryRun {
+		written = "to write (dry run)"
+	}
+	elapsed := time.Since(p.started)
+	fmt.Fprintf(w, "%s: %d events in %v (%.0f/s): %d %s of which %d without sg_event_id (not deduplicable), %d duplicates, %d invalid, %d dead-lettered; %d malformed records skipped\n",
+		state, p.total, elapsed.Round(time.Second), float64(p.total)/max(elapsed.Seconds(), 0.001),
+		p.counts[ingestWritten], written, p.unkeyed, p.counts[ingestDuplicate], p.counts[ingestInvalid], p.counts[ingestFailed], p.malformed)
+}
+
+// runReplay pushes archived events through ingestEvent, which writes them
+// as the workers write posted ones, so validation, dedupe and the
+// forward-only timestamps of email_subscriptions apply to a backfill too.
+// Dedupe goes by sg_event_id: events without one are written again by
+// every replay of the file, and are counted apart so that shows.
+func runReplay(w io.Writer, args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	format := flags.String("format", "auto", "json (arrays or NDJSON), csv, or auto from the file extension")
+	rate := flags.Int("rate", 0, "events per second at most, 0 for no limit")
+	dryRun := flags.Bool("dry-run", false, "decode, validate and check for duplicates without writing")
+	every := flags.Duration("progress", 5*time.Second, "how often to report progress, 0 for only at the end")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: replay [-format auto|json|csv] [-rate n] [-dry-run] [-progress d] <file>")
+	}
+	path := flags.Arg(0)
+	read := readEvents
+	switch *format {
+	case "auto":
+		if strings.EqualFold(filepath.Ext(path), ".csv") {
+			read = readCSVEvents
+		}
+	case "json":
+	case "csv":
+		read = readCSVEvents
+	default:
+		return fmt.Errorf("unknown -format %q, want auto, json or csv", *format)
+	}
+	if *rate < 0 {
+		return fmt.Errorf("-rate %d: want 0 or more events per second", *rate)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var throttle <-chan time.Time
+	if *rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(*rate))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+	var tick <-chan time.Time
+	if *every > 0 {
+		ticker := time.NewTicker(*every)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	ctx := context.Background()
+	progress := &replayProgress{started: time.Now(), dryRun: *dryRun, counts: map[ingestOutcome]int{}}
+	seen := map[string]bool{} // sg_event_ids of the dry run, standing in for email_events
+	err = read(file, func(event Event) error {
+		if throttle != nil {
+			<-throttle
+		}
+		select {
+		case <-tick:
+			progress.report(w, false)
+		default:
+		}
+
+		var (
+			outcome ingestOutcome
+			err     error
+		)
+		if *dryRun {
+			outcome = ingestWritten
+			if err = event.validate(); err != nil {
+				outcome = ingestInvalid
+			} else if recorded, err := eventRecorded(ctx, event.SgEventId); err != nil {
+				return err
+			} else if recorded || seen[event.SgEventId] {
+				outcome = ingestDuplicate
+			}
+			if event.SgEventId != "" {
+				seen[event.SgEventId] = true
+			}
+		} else {
+			outcome, err = ingestEvent(ctx, event)
+		}
+		progress.counts[outcome]++
+		progress.total++
+		if outcome == ingestWritten && event.SgEventId == "" {
+			progress.unkeyed++
+		}
+		switch outcome {
+		case ingestInvalid:
+			fmt.Fprintln(w, "skipped:", err)
+		case ingestFailed:
+			fmt.Fprintln(w, "dead-lettered:", err)
+		}
+		return nil
+	}, func(err error) {
+		progress.malformed++
+		fmt.Fprintln(w, "malformed, skipped:", err)
+	})
+	progress.report(w, true)
+	return err
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var readEventsTests = []struct {
+	name      string
+	csv       bool
+	input     string
+	emails    []string
+	malformed int
+	err       string // a fatal error, empty for none
+}{
+	{
+		name:   "ndjson",
+		input:  `{"email":"a@x.com","event":"open","timestamp":1}` + "\n" + `{"email":"b@x.com","event":"click","timestamp":2}` + "\n",
+		emails: []string{"a@x.com", "b@x.com"},
+	},
+	{
+		name:   "arrays",
+		input:  `[{"email":"a@x.com","event":"open","timestamp":1},{"email":"b@x.com","event":"open","timestamp":2}]` + "\n" + `[{"email":"c@x.com","event":"open","timestamp":3}]`,
+		emails: []string{"a@x.com", "b@x.com", "c@x.com"},
+	},
+	{
+		name:   "pretty printed array",
+		input:  "[\n  {\"email\": \"a@x.com\", \"event\": \"open\", \"timestamp\": 1}\n]\n",
+		emails: []string{"a@x.com"},
+	},
+	{
+		name:      "broken line in ndjson",
+		input:     `{"email":"a@x.com","event":"open","timestamp":1}` + "\n" + `{"email":"b@x.com",` + "\n" + `{"email":"c@x.com","event":"open","timestamp":3}` + "\n",
+		emails:    []string{"a@x.com", "c@x.com"},
+		malformed: 1,
+	},
+	{
+		name:      "undecodable event in an array",
+		input:     `[{"email":"a@x.com","event":"open","timestamp":1},{"email":"b@x.com","timestamp":"soon"}]`,
+		emails:    []string{"a@x.com"},
+		malformed: 1,
+	},
+	{
+		name:      "not an event",
+		input:     "42\n" + `{"email":"a@x.com","event":"open","timestamp":1}`,
+		emails:    []string{"a@x.com"},
+		malformed: 1,
+	},
+	{
+		name:      "truncated last value",
+		input:     `{"email":"a@x.com","event":"open","timestamp":1}` + "\n" + `{"email":"b@x`,
+		emails:    []string{"a@x.com"},
+		malformed: 1,
+	},
+	{
+		name:   "csv",
+		csv:    true,
+		input:  "Email,Event,Processed,Extra\na@x.com,open,1700000000,kept\nb@x.com,click,2023-11-14 22:13:20,\n",
+		emails: []string{"a@x.com", "b@x.com"},
+	},
+	{
+		name:      "csv bad timestamp and quoting",
+		csv:       true,
+		input:     "email,event,timestamp\na@x.com,open,yesterday\nb@x.com,op\"en,1\nc@x.com,open,1\n",
+		emails:    []string{"c@x.com"},
+		malformed: 2,
+	},
+	{
+		name:  "csv without an email column",
+		csv:   true,
+		input: "address,event,timestamp\na@x.com,open,1\n",
+		err:   "no email column",
+	},
+}
+
+func TestReadEvents(t *testing.T) {
+	for _, tt := range readEventsTests {
+		read := readEvents
+		if tt.csv {
+			read = readCSVEvents
+		}
+		var (
+			emails    []string
+			malformed []error
+		)
+		err := read(strings.NewReader(tt.input), func(event Event) error {
+			emails = append(emails, event.Email)
+			return nil
+		}, func(err error) {
+			malformed = append(malformed, err)
+		})
+
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: unexpected %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: error = %v, want one about %q", tt.name, err, tt.err)
+		}
+		if !reflect.DeepEqual(emails, tt.emails) {
+			t.Errorf("%s: emails = %q, want %q", tt.name, emails, tt.emails)
+		}
+		if len(malformed) != tt.malformed {
+			t.Errorf("%s: %d malformed %v, want %d", tt.name, len(malformed), malformed, tt.malformed)
+		}
+	}
+}
+
+func TestReadEventsStopsOnEachError(t *testing.T) {
+	input := `{"email":"a@x.com","event":"open","timestamp":1}` + "\n" + `{"email":"b@x.com","event":"open","timestamp":2}`
+	read := 0
+	err := readEvents(strings.NewReader(input), func(Event) error {
+		read++
+		return fmt.Errorf("database down")
+	}, func(error) {})
+	if err == nil || read != 1 {
+		t.Errorf("read %d events, error %v; want 1 and the callback's error", read, err)
+	}
+}
+
+func TestParseCSVTimestamp(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"1700000000", 1700000000, true},
+		{"2023-11-14T22:13:20Z", 1700000000, true},
+		{"2023-11-14T22:13:20+02:00", 1699992800, true},
+		{"2023-11-14 22:13:20", 1700000000, true},
+		{"2023-11-14T22:13:20", 1700000000, true},
+		{"2023-11-14 22:13:20.000", 1700000000, true},
+		{"", 0, false},
+		{"14/11/2023", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseCSVTimestamp(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseCSVTimestamp(%q) = %d, %v; want %d, ok %v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestReadCSVEventsLines(t *testing.T) {
+	input := "email,event,timestamp,reason\n" +
+		"a@x.com,bounce,1,\"mailbox\nfull\"\n" + // lines 2 and 3
+		"b@x.com,open,yesterday,\n" + // line 4
+		"c@x.com,open,1,\n"
+	var malformed []string
+	readCSVEvents(strings.NewReader(input), func(Event) error { return nil }, func(err error) {
+		malformed = append(malformed, err.Error())
+	})
+	if len(malformed) != 1 || !strings.HasPrefix(malformed[0], "line 4:") {
+		t.Errorf("malformed %q, want one on line 4", malformed)
+	}
+}
+
+// A dry run checks events without sg_event_id against nothing, so it needs
+// no database for them.
+func TestReplayReportsUnkeyed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.json")
+	input := `{"email":"a@x.com","event":"open","timestamp":1}` + "\n" + `{"email":"a@x.com","event":"open","timestamp":1}` + "\n"
+	if err := ioutil.WriteFile(path, []byte(input), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	if err := runReplay(&out, []string{"-dry-run", "-progress", "0", path}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "2 to write (dry run) of which 2 without sg_event_id (not deduplicable), 0 duplicates") {
+		t.Errorf("report %q does not set the events without sg_event_id apart", out.String())
+	}
+}
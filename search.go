@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/MakeNowJust/heredoc"
+	"github.com/gin-gonic/gin"
+)
+
+type SearchSuggestion struct {
+	ID         int    `db:"id"`
+	Title      string `db:"title"`
+	SystemName string `db:"system_name"`
+	SaleID     int    `db:"sale_id"`
+
+	// set for categories only
+	Parent   string `db:"parent"`
+	Products int    `db:"products"`
+}
+type SearchSuggestions []SearchSuggestion
+
+type Suggestion struct {
+	Href     string `json:"href"`
+	Label    string `json:"label"`
+	Products int    `json:"products,omitempty"` // of a category
+}
+
+type SuggestionGroup struct {
+	Vertical string       `json:"vertical"`
+	Heading  string       `json:"heading"`
+	Total    int          `json:"total"`
+	Items    []Suggestion `json:"items"`
+	SeeAll   *Suggestion  `json:"see_all,omitempty"`
+
+	// Fuzzy is set when the items come from the trigram fallback, and
+	// ShowingResultsFor then holds the word that was actually matched.
+	Fuzzy             bool   `json:"fuzzy,omitempty"`
+	ShowingResultsFor string `json:"showing_results_for,omitempty"`
+
+	// ConvertedTerm is the term read in the other keyboard layout, set when
+	// its matches were merged into the items.
+	ConvertedTerm string `json:"converted_term,omitempty"`
+}
+
+func processSearchSuggestion(c *gin.Context) {
+	query := c.DefaultQuery("term", "")
+	selected := verticals.Select(c.Query("verticals"))
+	ctx, ok := searchContext(c)
+	if !ok {
+		return
+	}
+	if normalizeTerm(query) == "" {
+		c.JSON(http.StatusOK, emptyTermSuggestions(ctx, c, selected))
+		return
+	}
+
+	started := time.Now()
+	autocorrect := c.Query("autocorrect") == "1"
+	if _, preview := isPreview(ctx); preview {
+		// previews bypass the cache and stay out of the analytics
+		c.Header("Cache-Control", "no-store")
+		if response := computeSuggestions(ctx, normalizeTerm(query), selected, autocorrect); response != nil {
+			c.Data(http.StatusOK, "application/json; charset=utf-8", response.Body)
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to render suggestions"})
+		return
+	}
+
+	key := suggestionCacheKey(query, selected, autocorrect)
+	response, _ := suggestionCache.Get(ctx, key, func(ctx context.Context) *cachedSuggestions {
+		return computeSuggestions(ctx, normalizeTerm(query), selected, autocorrect)
+	})
+	if response == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to render suggestions"})
+		return
+	}
+
+	searchID := randomID()
+	logSearchQuery(SearchQueryLog{
+		SearchID:  searchID,
+		Term:      query,
+		SessionID: sessionID(c),
+		Counts:    response.Counts,
+		Latency:   time.Since(started),
+	})
+
+	c.Header(searchIdHeader, searchID)
+	c.Header("ETag", response.ETag)
+	if maxAge := suggestionCache.maxAge(); maxAge > 0 {
+		// private: the response carries the search id and may set the
+		// session cookie, neither of which a shared cache may hand out
+		c.Header("Cache-Control", fmt.Sprintf("private, max-age=%d", maxAge))
+		c.Header("Vary", "Cookie")
+	}
+	if c.GetHeader("If-None-Match") == response.ETag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", response.Body)
+}
+
+// computeSuggestions runs every selected vertical for query, falling back
+// to spelling corrections when none of them matches. A response missing
+// a vertical that timed out is marked partial, so it is not cached.
+func computeSuggestions(ctx context.Context, query string, selected Verticals, autocorrect bool) *cachedSuggestions {
+	ctx, timeouts := trackQueryTimeouts(ctx)
+	counts := map[string]int{}
+	groups := []SuggestionGroup{}
+	for _, v := range selected {
+		counts[v.Name] = 0
+		if group, ok := suggestVertical(ctx, v, query); ok {
+			counts[v.Name] = group.Total
+			groups = append(groups, group)
+		}
+	}
+	if len(groups) == 0 {
+		groups = correctedSuggestions(ctx, query, selected, autocorrect)
+	}
+	response := renderSuggestions(groups, counts)
+	if response != nil {
+		response.partial = atomic.LoadInt32(timeouts) > 0
+	}
+	return response
+}
+
+// correctedSuggestions handles a term nothing matched: it offers spelling
+// corrections and, when asked to, shows the results of the best one.
+func correctedSuggestions(ctx context.Context, query string, selected Verticals, autocorrect bool) []SuggestionGroup {
+	groups := []SuggestionGroup{}
+	corrections := didYouMean(query)
+	if len(corrections) == 0 {
+		return groups
+	}
+	if autocorrect {
+		for _, v := range selected {
+			if group, ok := suggestVertical(ctx, v, corrections[0]); ok {
+				group.ShowingResultsFor = corrections[0]
+				groups = append(groups, group)
+			}
+		}
+	}
+	return append(groups, searchTermsGroup("did_you_mean", "Did you mean", corrections))
+}
+
+// suggestVertical runs the suggestion pipeline of one vertical: prefix
+// match, the term in the other keyboard layout, then the trigram fallback.
+// It gives up between stages once ctx is done.
+func suggestVertical(ctx context.Context, v *Vertical, query string) (group SuggestionGroup, ok bool) {
+	group = SuggestionGroup{Vertical: v.Name, Heading: v.Heading, Items: []Suggestion{}}
+	matched := []string{query}
+
+	total, ids := backend(ctx).SearchIds(ctx, v, query)
+	if ctx.Err() != nil {
+		return
+	}
+	if converted, likely := switchLayout(query); converted != "" && (likely || total == 0) {
+		if convertedTotal, convertedIds := backend(ctx).SearchIds(ctx, v, converted); convertedTotal > 0 {
+			total, ids = mergeIds(total, ids, convertedTotal, convertedIds, v.Limit)
+			group.ConvertedTerm = converted
+			matched = append(matched, converted)
+		}
+	}
+	if total < fuzzy.MinResults && ctx.Err() == nil {
+		if f := backend(ctx).FuzzySearchIds(ctx, v, query); f.Total > total {
+			total, ids = f.Total, f.Ids
+			group.Fuzzy = true
+			group.ConvertedTerm = ""
+			matched = []string{query}
+			if f.Corrected != "" && !strings.EqualFold(f.Corrected, query) {
+				group.ShowingResultsFor = f.Corrected
+				matched = []string{f.Corrected}
+			}
+		}
+	}
+	if total == 0 || ctx.Err() != nil {
+		return
+	}
+
+	group.Total = total
+	for _, x := range backend(ctx).Items(ctx, v, ids) {
+		group.Items = append(group.Items, Suggestion{
+			Href:     v.HrefFor(x),
+			Label:    highlight(x.Title, matched...),
+			Products: x.Products,
+		})
+	}
+	if seeAll, ok := v.SeeAllFor(query, total); ok && total > len(group.Items) {
+		group.SeeAll = &seeAll
+	}
+	return group, true
+}
+
+// mergeIds appends the ids of a second search to the first one, dropping
+// duplicates. The total is approximate: only the overlap among the fetched
+// ids is known.
+func mergeIds(total int, ids []int, otherTotal int, otherIds []int, limit int) (int, []int) {
+	seen := map[int]bool{}
+	for _, id := range ids {
+		seen[id] = true
+	}
+	total += otherTotal
+	for _, id := range otherIds {
+		if seen[id] {
+			total--
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	if limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
+	}
+	return total, ids
+}
+
+// highlight marks the first of terms that occurs in label, keeping the
+// label's own casing. The result is HTML: label is escaped.
+func highlight(label string, terms ...string) string {
+	for _, term := range terms {
+		if strings.TrimSpace(term) == "" {
+			continue
+		}
+		re := regexp.MustCompile("(?i)" + regexp.QuoteMeta(term))
+		matches := re.FindAllStringIndex(label, -1)
+		if matches == nil {
+			continue
+		}
+		var out bytes.Buffer
+		last := 0
+		for _, m := range matches {
+			out.WriteString(html.EscapeString(label[last:m[0]]))
+			out.WriteString("<b style='background: yellow;'>" + html.EscapeString(label[m[0]:m[1]]) + "</b>")
+			last = m[1]
+		}
+		out.WriteString(html.EscapeString(label[last:]))
+		return out.String()
+	}
+	return html.EscapeString(label)
+}
+
+// whereClause turns a vertical's extra condition into an AND-able fragment.
+func whereClause(where string) string {
+	if where == "" {
+		return ""
+	}
+	return "AND (" + where + ")"
+}
+
+func getAO(ctx context.Context, prefix string) (result string) {
+	type AOIds struct {
+		Id int `db:"id"`
+	}
+	var productSubCatIds []AOIds
+	result = "AND 1=1"
+
+	_, productsOnlySubCatIds, ok := adultsOnlyCategories()
+	if !ok || len(productsOnlySubCatIds) == 0 {
+		return
+	}
+	request := heredoc.Docf(`
+		SELECT "%sproducts_sub_categories"."product_id" id
+		FROM "%sproducts_sub_categories"
+		WHERE "%sproducts_sub_categories"."sub_category_id" IN (%s)
+	`, prefix, prefix, prefix, arrayToString(productsOnlySubCatIds, ","))
+	if err := selectContext(ctx, searchDB, opHydrate, &productSubCatIds, request); err != nil && err != sql.ErrNoRows {
+		return
+	}
+
+	if len(productSubCatIds) > 0 {
+		var pairs []int
+		for _, x := range productSubCatIds {
+			pairs = append(pairs, x.Id)
+		}
+		return heredoc.Docf(`
+			AND "%sproducts"."id" NOT IN (%s)
+		`, prefix, arrayToString(pairs, ","))
+	} else {
+		return
+	}
+}
+
+// adultsOnlyCategories lists the active categories under adults-only, and
+// the sub-categories attached to them.
+func adultsOnlyCategories() (categoryIds []int, subCategoryIds []int, ok bool) {
+	tree := currentCategoryTree()
+	if tree == nil {
+		return
+	}
+	root := tree.Category(adultsOnlySystemName)
+	if root == nil {
+		return
+	}
+
+	categoryIds = []int{}
+	var active []*Category
+	for _, c := range append([]*Category{root}, tree.Descendants(root)...) {
+		if c.IsActive {
+			active = append(active, c)
+			categoryIds = append(categoryIds, c.ID)
+		}
+	}
+	return categoryIds, tree.SubCategoryIds(active), true
+}
+
+func filterShopProducts(ctx context.Context, ids []int) (result SearchSuggestions) {
+	var (
+		adults string = getAO(ctx, "shop_")
+		order  []string
+	)
+
+	for i, p := range ids {
+		order = append(order, fmt.Sprintf("(%d,%d)", p, i))
+	}
+	request := heredoc.Docf(`
+		SELECT "shop_products"."id", COALESCE("shop_products"."title", '') title, '' system_name, "shop_products"."sale_id"
+		FROM "shop_products"
+		JOIN (values %s) AS x(id, ordering) ON "shop_products".id = x.id
+		WHERE "shop_products"."id" IN (%s) %s
+		ORDER BY x.ordering
+	`, strings.Join(order, ","), arrayToString(ids, ","), adults)
+
+	if err := selectContext(ctx, searchDB, opHydrate, &result, request); err != nil && err != sql.ErrNoRows {
+		result = SearchSuggestions{}
+		return
+	}
+
+	return
+}
+
+func filterCoupons(ctx context.Context, ids []int) (result SearchSuggestions) {
+	var (
+		adults string = getAO(ctx, "")
+		order  []string
+	)
+
+	for i, p := range ids {
+		order = append(order, fmt.Sprintf("(%d,%d)", p, i))
+	}
+	request := heredoc.Docf(`
+		SELECT "products"."id", COALESCE("products"."title", '') title, COALESCE("products"."system_name", '') system_name, 0 sale_id
+		FROM "products"
+		JOIN (values %s) AS x(id, ordering) ON "products".id = x.id
+		WHERE "products"."id" IN (%s) %s
+		ORDER BY x.ordering
+	`, strings.Join(order, ","), arrayToString(ids, ","), adults)
+
+	if err := selectContext(ctx, searchDB, opHydrate, &result, request); err != nil && err != sql.ErrNoRows {
+		result = SearchSuggestions{}
+		return
+	}
+
+	return
+}
+
+// couponsSoldSQL is the units sold of a coupon, the counterpart of the
+// quantity_bought summed over a shop product's catalogs.
+const couponsSoldSQL = `COALESCE("products"."quantity_bought", 0)::float8`
+
+// couponMatchesSQL selects the searchable coupons matching term, every one
+// of them when term is empty, with the columns ranking, sorting and
+// filtering need: pg_search_rank, sold, starts_at, ends_at and price. cond
+// is AND-ed to the conditions.
+func couponMatchesSQL(ctx context.Context, term string, cond string) string {
+	rank, match := "0::float8", ""
+	if term != "" {
+		rank = fmt.Sprintf(`ts_rank("products"."tsv", %s, 0)::float8`, tsQuery(term))
+		match = fmt.Sprintf(`AND ("products"."tsv" @@ %s OR "products"."tsv" @@ %s)`, tsQuery(term), tsQueryReversed(term))
+	}
+	return heredoc.Docf(`
+		SELECT products.id, COALESCE(products.title, '') title, COALESCE(products.system_name, '') system_name, 0 sale_id,
+			%s AS pg_search_rank, %s AS sold,
+			products.valid_from AS starts_at, products.valid_until AS ends_at,
+			COALESCE(products.price, 0)::float8 AS price
+		FROM products
+		WHERE ready = 't' AND visible = 't' AND %s BETWEEN valid_from AND valid_until
+			%s
+			%s
+	`, rank, couponsSoldSQL, timestampSQL(searchTime(ctx)), cond, match)
+}
+
+// shopMatchesSQL is couponMatchesSQL for shop products: hidden sales only
+// for their final-sale products, no delivery products.
+func shopMatchesSQL(ctx context.Context, term string, cond string) (request string, ok bool) {
+	finalSaleIds, ok := finalSaleProductIds(ctx)
+	if !ok {
+		return
+	}
+	rank, match := "0::float8", ""
+	if term != "" {
+		rank = fmt.Sprintf(`(ts_rank("shop_products"."tsv", %s, 0) + ts_rank("shop_products"."tsv", %s, 0))::float8`,
+			tsQuery(term), tsQueryReversed(term))
+		match = fmt.Sprintf(`AND ("shop_products"."tsv" @@ %s OR "shop_products"."tsv" @@ %s)`, tsQuery(term), tsQueryReversed(term))
+	}
+	request = heredoc.Docf(`
+		SELECT shop_products.id, COALESCE(shop_products.title, '') title, '' system_name, shop_products.sale_id,
+			%s AS pg_search_rank,
+			COALESCE(SUM(shop_catalogs.quantity_bought), 0)::float8 AS sold,
+			shop_sales.start_date AS starts_at, shop_sales.end_date AS ends_at,
+			COALESCE(MIN(shop_catalogs.price), 0)::float8 AS price
+		FROM shop_products
+		INNER JOIN shop_option_types ON shop_option_types.product_id = shop_products.id
+		INNER JOIN shop_catalogs ON shop_catalogs.option_type_id = shop_option_types.id
+		JOIN shop_sales ON shop_products.sale_id = shop_sales.id
+		WHERE (shop_sales.hidden = 'f' OR shop_products.id IN (%s)) AND shop_sales.status = 'READY' AND
+			%s BETWEEN shop_sales.start_date AND shop_sales.end_date AND shop_products.delivery_product = false
+			%s
+			%s
+		GROUP BY shop_products.id, shop_sales.start_date, shop_sales.end_date
+	`, rank, arrayToString(finalSaleIds, ","), timestampSQL(searchTime(ctx)), cond, match)
+	return request, true
+}
+
+func ProductSearchIds(ctx context.Context, unsanitizedTerm string, limit int, where string, order string) (total int, ids []int) {
+	term := sanitize(unsanitizedTerm)
+	return searchIds(ctx, couponMatchesSQL(ctx, term, whereClause(where)), term, limit, order)
+}
+
+func ShopProductSearchIds(ctx context.Context, unsanitizedTerm string, limit int, where string, order string) (total int, ids []int) {
+	term := sanitize(unsanitizedTerm)
+	matches, ok := shopMatchesSQL(ctx, term, whereClause(where))
+	if !ok {
+		return
+	}
+	return searchIds(ctx, matches, term, limit, order)
+}
+
+// searchIds ranks the rows of matches, newest first when there is no term
+// to rank by.
+func searchIds(ctx context.Context, matches string, term string, limit int, order string) (total int, ids []int) {
+	orderQ := rankingSQL(currentRanking(), timestampSQL(searchTime(ctx)), "pg_search_rank", "sold", "starts_at", "ends_at") + " DESC, id DESC"
+	if order == orderNewest || term == "" {
+		orderQ = "id DESC"
+	}
+	request := heredoc.Docf(`
+		WITH matches AS (
+		%s
+		)
+		SELECT id, (SELECT COUNT(1) FROM matches) AS total
+		FROM matches
+		ORDER BY %s
+		%s
+	`, matches, orderQ, limitClause(limit))
+
+	type Results struct {
+		Id    int `db:"id"`
+		Total int `db:"total"`
+	}
+	results := []Results{}
+	if err := selectContext(ctx, searchDB, opSearch, &results, request); err != nil {
+		fmt.Println("search error:", err)
+		return
+	}
+	if len(results) == 0 {
+		return
+	}
+	total = results[0].Total
+	for _, r := range results {
+		ids = append(ids, r.Id)
+	}
+	return
+}
+
+// finalSaleProductIds lists shop products in the final-sale sub-category,
+// which stay searchable even when their sale is hidden. It never returns an
+// empty list so the result can go straight into an IN (...) clause.
+func finalSaleProductIds(ctx context.Context) (ids []int, ok bool) {
+	ids = []int{}
+	request := heredoc.Doc(`
+		SELECT "shop_products"."id"
+		FROM "shop_products"
+		INNER JOIN "shop_products_sub_categories" ON "shop_products"."id" = "shop_products_sub_categories"."product_id"
+		WHERE "shop_products_sub_categories"."sub_category_id" IN
+			(SELECT "sub_categories".id FROM "sub_categories" WHERE "sub_categories"."system_name" = 'final-sale')
+	`)
+	if err := selectContext(ctx, searchDB, opHydrate, &ids, request); err != nil {
+		return
+	}
+	if len(ids) == 0 {
+		ids = []int{0}
+	}
+	return ids, true
+}
+
+// tsQuery is the prefix tsquery for an already sanitized term, OR-ed with
+// the prefix tsqueries of its synonyms. Each is parsed with the text search
+// configuration of its language, so English terms get stemmed, and with
+// 'simple', which the tsv columns are built with.
+func tsQuery(term string) string {
+	q := prefixTsQuery(term)
+	for _, s := range synonymsFor(term) {
+		q += " || " + prefixTsQuery(sanitize(s))
+	}
+	return "(" + q + ")"
+}
+
+func prefixTsQuery(term string) string {
+	simple := fmt.Sprintf(`to_tsquery('simple', ''' ' || '%s' || ' ''' || ':*')`, term)
+	config := textSearch.configFor(term)
+	if config == "simple" {
+		return simple
+	}
+	// a stemmed prefix ("parti" for party) misses the unstemmed lexemes
+	// and a stop word parses to an empty query, so simple stays in
+	return fmt.Sprintf(`(to_tsquery('%s', ''' ' || '%s' || ' ''' || ':*') || %s)`, config, term, simple)
+}
+
+// tsQueryReversed matches the term typed backwards, which happens with
+// Hebrew input in left-to-right fields.
+func tsQueryReversed(term string) string {
+	return fmt.Sprintf(`to_tsquery('simple', ''' ' || reverse('%s') || ' ''' || ':*')`, term)
+}
+
+func arrayToString(a []int, delim string) string {
+	return strings.Trim(strings.Replace(fmt.Sprint(a), " ", delim, -1), "[]")
+	//return strings.Trim(strings.Join(strings.Split(fmt.Sprint(a), " "), delim), "[]")
+	//return strings.Trim(strings.Join(strings.Fields(fmt.Sprint(a)), delim), "[]")
+}
+
+func sanitize(term string) (query string) {
+	query = ""
+	for _, ch := range term {
+		if ch == '\'' || ch == '?' || ch == '\\' || ch == ':' || ch == ';' {
+			query += " "
+		} else {
+			query += string(ch)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MakeNowJust/heredoc"
+)
+
+const (
+	vocabularyRefreshInterval = time.Hour
+	maxSpellingSuggestions    = 3
+)
+
+var (
+	vocabularyMu sync.RWMutex
+	vocabulary   = map[string]int{} // lexeme -> number of documents
+)
+
+// refreshVocabulary keeps the spelling vocabulary current.
+func refreshVocabulary() {
+	for {
+		loadVocabulary()
+		time.Sleep(vocabularyRefreshInterval)
+	}
+}
+
+// loadVocabulary rebuilds the spelling vocabulary from the lexemes of the
+// searchable products and shop products.
+func loadVocabulary() {
+	type Row struct {
+		Word    string `db:"word"`
+		Entries int    `db:"entries"`
+	}
+	rows := []Row{}
+	request := heredoc.Doc(`
+		SELECT word, SUM(ndoc)::int AS entries
+		FROM (
+			SELECT word, ndoc FROM ts_stat($$SELECT tsv FROM products WHERE ready = 't' AND visible = 't'$$)
+			UNION ALL
+			SELECT word, ndoc FROM ts_stat($$SELECT tsv FROM shop_products WHERE delivery_product = false$$)
+		) words
+		WHERE length(word) > 1
+		GROUP BY word
+	`)
+	if err := searchDB.Select(&rows, request); err != nil {
+		fmt.Println("Unable to build spelling vocabulary:", err)
+		return
+	}
+	loaded := make(map[string]int, len(rows))
+	for _, r := range rows {
+		loaded[r.Word] = r.Entries
+	}
+	vocabularyMu.Lock()
+	vocabulary = loaded
+	vocabularyMu.Unlock()
+}
+
+// didYouMean proposes corrected versions of term, best first. Every word
+// is replaced by the closest known lexeme, preferring frequent ones; a
+// single word term gets a few alternatives.
+func didYouMean(term string) (suggestions []string) {
+	words := strings.Fields(strings.ToLower(term))
+	if len(words) == 0 {
+		return
+	}
+
+	vocabularyMu.RLock()
+	defer vocabularyMu.RUnlock()
+
+	if len(words) == 1 {
+		return closestWords(words[0], maxSpellingSuggestions)
+	}
+
+	changed := false
+	for i, w := range words {
+		if _, known := vocabulary[w]; known {
+			continue
+		}
+		if best := closestWords(w, 1); len(best) > 0 {
+			words[i] = best[0]
+			changed = true
+		}
+	}
+	if changed {
+		suggestions = append(suggestions, strings.Join(words, " "))
+	}
+	return
+}
+
+// closestWords must be called with vocabularyMu held.
+func closestWords(word string, n int) []string {
+	type candidate struct {
+		word     string
+		distance int
+		entries  int
+	}
+
+	// one typo per four letters, at most two
+	maxDistance := 1
+	if len([]rune(word)) > 4 {
+		maxDistance = 2
+	}
+
+	var candidates []candidate
+	length := len([]rune(word))
+	for w, entries := range vocabulary {
+		l := len([]rune(w))
+		if l < length-maxDistance || l > length+maxDistance || w == word {
+			continue
+		}
+		if d := editDistance(word, w); d <= maxDistance {
+			candidates = append(candidates, candidate{w, d, entries})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].distance != candidates[j].distance {
+			return candidates[i].distance < candidates[j].distance
+		}
+		if candidates[i].entries != candidates[j].entries {
+			return candidates[i].entries > candidates[j].entries
+		}
+		return candidates[i].word < candidates[j].word
+	})
+
+	var result []string
+	for i := 0; i < len(candidates) && i < n; i++ {
+		result = append(result, candidates[i].word)
+	}
+	return result
+}
+
+// editDistance is the optimal string alignment distance between a and b:
+// insertions, deletions, substitutions and transpositions of adjacent
+// letters all cost one.
+func editDistance(a, b string) int {
+	s, t := []rune(a), []rune(b)
+	d := make([][]int, len(s)+1)
+	for i := range d {
+		d[i] = make([]int, len(t)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(min(d[i-1][j]+1, d[i][j-1]+1), d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && s[i-1] == t[j-2] && s[i-2] == t[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(s)][len(t)]
+}
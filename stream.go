@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+const (
+	streamHeartbeat     = 15 * time.Second
+	streamNotifyChannel = "search_stream_term"
+)
+
+// suggestionStream is an open /search/stream connection. Terms posted to
+// it replace each other: only the latest one is searched.
+type suggestionStream struct {
+	terms chan string
+}
+
+var (
+	streamsMu sync.Mutex
+	streams   = map[string]*suggestionStream{}
+
+	// streamsListening is set once terms posted to another instance reach
+	// this one's streams through streamNotifyChannel.
+	streamsListening bool
+
+	// streamSuggest searches one vertical for a stream.
+	streamSuggest = suggestVertical
+)
+
+// StreamResult is the "suggestions" event: the outcome of one vertical for
+// term. Group is nil when the vertical has no match.
+type StreamResult struct {
+	Term     string           `json:"term"`
+	Vertical string           `json:"vertical"`
+	Group    *SuggestionGroup `json:"group"`
+}
+
+// StreamDone is the "done" event, sent once every vertical answered term.
+// Corrections holds the did-you-mean groups when nothing matched.
+type StreamDone struct {
+	Term        string            `json:"term"`
+	SearchID    string            `json:"search_id"`
+	Corrections []SuggestionGroup `json:"corrections,omitempty"`
+}
+
+type streamGeneration struct {
+	term     string
+	started  time.Time
+	pending  int
+	counts   map[string]int
+	searchID string
+}
+
+// prepareSearchStreams listens for the terms posted to an instance that
+// does not hold the stream, so the POST needs no session affinity.
+func prepareSearchStreams() {
+	listener := pq.NewListener(config.DatabaseURL, time.Second, time.Minute, nil)
+	if err := listener.Listen(streamNotifyChannel); err != nil {
+		fmt.Println("Unable to listen for stream terms:", err)
+		return
+	}
+	streamsListening = true
+
+	go func() {
+		for n := range listener.NotificationChannel() {
+			if n == nil {
+				continue // reconnected; terms sent meanwhile are lost
+			}
+			if id, term, ok := strings.Cut(n.Extra, " "); ok {
+				sendStreamTerm(id, term)
+			}
+		}
+	}()
+}
+
+// processSearchStream keeps a Server-Sent Events connection open and pushes
+// the suggestions of each vertical as soon as they are ready. The first
+// event, "stream", carries the id to post further terms to; a new term
+// cancels the searches still running for the previous one.
+//
+//	GET  /search/stream?verticals=coupons,shop&term=sp
+//	POST /search/stream/:id   term=spa
+func processSearchStream(c *gin.Context) {
+	selected := verticals.Select(c.Query("verticals"))
+	base, ok := searchContext(c)
+	if !ok {
+		return
+	}
+	sid := sessionID(c)
+
+	id := randomID()
+	stream := &suggestionStream{terms: make(chan string, 1)}
+	streamsMu.Lock()
+	streams[id] = stream
+	streamsMu.Unlock()
+	defer func() {
+		streamsMu.Lock()
+		delete(streams, id)
+		streamsMu.Unlock()
+	}()
+	if term, ok := c.GetQuery("term"); ok {
+		stream.terms <- normalizeTerm(term)
+	}
+
+	type vertical struct {
+		generation int
+		name       string
+		group      SuggestionGroup
+		ok         bool
+	}
+	results := make(chan vertical, len(selected))
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	var (
+		generation int
+		current    streamGeneration
+		cancel     context.CancelFunc = func() {}
+	)
+	defer func() { cancel() }()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.SSEvent("stream", gin.H{"id": id})
+	c.Writer.Flush()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-base.Done():
+			return false
+
+		case <-heartbeat.C:
+			c.SSEvent("ping", "")
+
+		case term := <-stream.terms:
+			cancel()
+			var ctx context.Context
+			ctx, cancel = context.WithCancel(base)
+			generation++
+			current = streamGeneration{term: term, started: time.Now(), pending: len(selected), counts: map[string]int{}, searchID: randomID()}
+
+			if term == "" {
+				for _, group := range emptyTermSuggestions(base, c, selected) {
+					group := group
+					c.SSEvent("suggestions", StreamResult{Term: term, Vertical: group.Vertical, Group: &group})
+				}
+			}
+			if term == "" || len(selected) == 0 {
+				c.SSEvent("done", StreamDone{Term: term})
+				return true
+			}
+			for _, v := range selected {
+				go func(gen int, v *Vertical) {
+					group, ok := streamSuggest(ctx, v, term)
+					select {
+					case results <- vertical{gen, v.Name, group, ok}:
+					case <-ctx.Done():
+					}
+				}(generation, v)
+			}
+
+		case r := <-results:
+			if r.generation != generation {
+				return true // answer to a term that was replaced meanwhile
+			}
+			result := StreamResult{Term: current.term, Vertical: r.name}
+			current.counts[r.name] = 0
+			if r.ok {
+				result.Group = &r.group
+				current.counts[r.name] = r.group.Total
+			}
+			c.SSEvent("suggestions", result)
+
+			if current.pending--; current.pending == 0 {
+				done := StreamDone{Term: current.term, SearchID: current.searchID}
+				matched := 0
+				for _, n := range current.counts {
+					matched += n
+				}
+				if matched == 0 {
+					done.Corrections = correctedSuggestions(base, current.term, selected, false)
+				}
+				if _, preview := isPreview(base); !preview {
+					logSearchQuery(SearchQueryLog{
+						SearchID:  current.searchID,
+						Term:      current.term,
+						SessionID: sid,
+						Counts:    current.counts,
+						Latency:   time.Since(current.started),
+					})
+				}
+				c.SSEvent("done", done)
+			}
+		}
+		return true
+	})
+}
+
+// postSearchStream sends the next term to an open stream. A stream held by
+// another instance gets it through streamNotifyChannel.
+func postSearchStream(c *gin.Context) {
+	var body struct {
+		Term string `json:"term" form:"term"` // empty asks for recent and trending
+	}
+	if err := c.ShouldBind(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	id, term := c.Param("id"), normalizeTerm(body.Term)
+
+	switch {
+	case sendStreamTerm(id, term):
+	case !streamsListening:
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown stream"})
+		return
+	default:
+		if _, err := dbx.Exec(`SELECT pg_notify($1, $2)`, streamNotifyChannel, id+" "+term); err != nil {
+			fmt.Println("Unable to forward stream term:", err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "stream unavailable"})
+			return
+		}
+	}
+	c.Status(http.StatusAccepted)
+}
+
+// sendStreamTerm hands term to the stream id if this instance holds it,
+// replacing a term the stream has not picked up yet.
+func sendStreamTerm(id, term string) bool {
+	streamsMu.Lock()
+	stream, ok := streams[id]
+	streamsMu.Unlock()
+	if !ok {
+		return false
+	}
+	for {
+		select {
+		case stream.terms <- term:
+			return true
+		default:
+		}
+		select {
+		case <-stream.terms:
+		default:
+		}
+	}
+}
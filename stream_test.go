@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type streamEvent struct {
+	name string
+	data string
+}
+
+// readStreamEvents parses the Server-Sent Events of body onto a channel,
+// closed when the body ends.
+func readStreamEvents(body *bufio.Scanner) <-chan streamEvent {
+	events := make(chan streamEvent)
+	go func() {
+		defer close(events)
+		var event streamEvent
+		for body.Scan() {
+			line := body.Text()
+			switch {
+			case strings.HasPrefix(line, "event:"):
+				event.name = strings.TrimPrefix(line, "event:")
+			case strings.HasPrefix(line, "data:"):
+				event.data = strings.TrimPrefix(line, "data:")
+			case line == "" && event.name != "":
+				events <- event
+				event = streamEvent{}
+			}
+		}
+	}()
+	return events
+}
+
+func TestSearchStreamReplacesTerm(t *testing.T) {
+	savedVerticals, savedSuggest := verticals, streamSuggest
+	t.Cleanup(func() { verticals, streamSuggest = savedVerticals, savedSuggest })
+	verticals = Verticals{{Name: "coupons"}}
+
+	// "sp" is searched until it is cancelled, then answers anyway; "spa"
+	// answers at once.
+	started, cancelled := make(chan struct{}), make(chan struct{})
+	streamSuggest = func(ctx context.Context, v *Vertical, term string) (SuggestionGroup, bool) {
+		if term == "sp" {
+			close(started)
+			<-ctx.Done()
+			close(cancelled)
+		}
+		return SuggestionGroup{Vertical: v.Name, Total: 1, Items: []Suggestion{{Label: term}}}, true
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/search/stream", processSearchStream)
+	r.POST("/search/stream/:id", postSearchStream)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/search/stream?term=sp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	events := readStreamEvents(bufio.NewScanner(resp.Body))
+	next := func() streamEvent {
+		t.Helper()
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatal("the stream ended")
+			}
+			return event
+		case <-time.After(time.Second):
+			t.Fatal("no event")
+		}
+		return streamEvent{}
+	}
+
+	var stream struct{ ID string }
+	if event := next(); event.name != "stream" || json.Unmarshal([]byte(event.data), &stream) != nil {
+		t.Fatalf("first event %v, want the stream id", event)
+	}
+	<-started
+
+	post := func(term string) {
+		t.Helper()
+		resp, err := http.PostForm(server.URL+"/search/stream/"+stream.ID, url.Values{"term": {term}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("posting %q: status %d, want 202", term, resp.StatusCode)
+		}
+	}
+	// readTerm reads up to the "done" of term, failing on anything about
+	// or found for another term.
+	readTerm := func(term string) {
+		t.Helper()
+		for {
+			event := next()
+			var about StreamResult
+			json.Unmarshal([]byte(event.data), &about)
+			if event.name != "ping" && about.Term != term {
+				t.Fatalf("%s event for %q while waiting for %q", event.name, about.Term, term)
+			}
+			if about.Group != nil && about.Group.Items[0].Label != term {
+				t.Fatalf("suggestions found for %q sent for %q", about.Group.Items[0].Label, term)
+			}
+			if event.name == "done" {
+				return
+			}
+		}
+	}
+
+	post("spa")
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("the search for the replaced term was not cancelled")
+	}
+	readTerm("spa")
+	time.Sleep(20 * time.Millisecond) // give a stale answer time to show up
+	post("spam")
+	readTerm("spam")
+}
+
+func TestPostSearchStreamUnknown(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/search/stream/:id", postSearchStream)
+	req := httptest.NewRequest("POST", "/search/stream/nope", strings.NewReader("term=spa"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status %d, want 404", w.Code)
+	}
+}
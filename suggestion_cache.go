@@ -0,0 +1,187 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cachedSuggestions is a rendered suggestion response. Counts is kept for
+// the analytics log, which still gets a row per request.
+type cachedSuggestions struct {
+	Body    []byte
+	ETag    string
+	Counts  map[string]int
+	expires time.Time
+	partial bool // some query timed out
+}
+
+// SuggestionCache is an LRU of suggestion responses with a TTL. Identical
+// requests arriving while one is being computed wait for it instead of
+// running the same queries again; the computation is cancelled once all of
+// them have given up.
+type SuggestionCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List // front is the most recently used
+	entries map[string]*list.Element
+	calls   map[string]*suggestionCall
+
+	// bumped by Purge, so a computation started before does not store
+	// its now stale result
+	generation uint64
+}
+
+type suggestionCacheEntry struct {
+	key   string
+	value *cachedSuggestions
+}
+
+type suggestionCall struct {
+	done    chan struct{} // closed once value is set
+	value   *cachedSuggestions
+	waiters int // callers still waiting, under SuggestionCache.mu
+	cancel  context.CancelFunc
+}
+
+var suggestionCache *SuggestionCache
+
+// prepareSuggestionCache applies the suggestion_cache settings; a size of
+// 0 disables the cache.
+func prepareSuggestionCache() {
+	if config.SuggestionCache.Size > 0 {
+		suggestionCache = newSuggestionCache(config.SuggestionCache.Size, config.SuggestionCache.TTL)
+	}
+}
+
+func newSuggestionCache(size int, ttl time.Duration) *SuggestionCache {
+	return &SuggestionCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+		calls:   map[string]*suggestionCall{},
+	}
+}
+
+// suggestionCacheKey identifies a response. The term is normalized so "spa"
+// and "Spa " share an entry. Adults-only items are excluded for everyone
+// by getAO, so the adults filter adds nothing to the key today; it belongs
+// here once callers can opt in.
+func suggestionCacheKey(term string, selected Verticals, autocorrect bool) string {
+	names := make([]string, len(selected))
+	for i, v := range selected {
+		names[i] = v.Name
+	}
+	return fmt.Sprintf("%s\x00%s\x00%t", normalizeTerm(term), strings.Join(names, ","), autocorrect)
+}
+
+// Get returns the response for key, computing it at most once for all the
+// concurrent callers. compute gets a context carrying the values of ctx,
+// cancelled when every caller's ctx is; a caller whose ctx ends first gets
+// nil. A nil cache computes every time.
+func (sc *SuggestionCache) Get(ctx context.Context, key string, compute func(context.Context) *cachedSuggestions) (value *cachedSuggestions, hit bool) {
+	if sc == nil {
+		return compute(ctx), false
+	}
+
+	sc.mu.Lock()
+	if el, ok := sc.entries[key]; ok {
+		entry := el.Value.(*suggestionCacheEntry)
+		if time.Now().Before(entry.value.expires) {
+			sc.order.MoveToFront(el)
+			sc.mu.Unlock()
+			return entry.value, true
+		}
+		sc.order.Remove(el)
+		delete(sc.entries, key)
+	}
+	call, shared := sc.calls[key]
+	if !shared {
+		loadCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &suggestionCall{done: make(chan struct{}), cancel: cancel}
+		sc.calls[key] = call
+		go sc.load(loadCtx, key, call, sc.generation, compute)
+	}
+	call.waiters++
+	sc.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.value, shared
+	case <-ctx.Done():
+		sc.mu.Lock()
+		if call.waiters--; call.waiters == 0 {
+			call.cancel()
+			if sc.calls[key] == call {
+				delete(sc.calls, key) // later callers start afresh
+			}
+		}
+		sc.mu.Unlock()
+		return nil, shared
+	}
+}
+
+// load computes call and stores its value unless it is partial, was
+// cancelled or started before a Purge.
+func (sc *SuggestionCache) load(ctx context.Context, key string, call *suggestionCall, generation uint64, compute func(context.Context) *cachedSuggestions) {
+	defer call.cancel()
+	call.value = compute(ctx)
+
+	sc.mu.Lock()
+	if sc.calls[key] == call {
+		delete(sc.calls, key)
+	}
+	if call.value != nil && !call.value.partial && ctx.Err() == nil && sc.generation == generation {
+		call.value.expires = time.Now().Add(sc.ttl)
+		sc.entries[key] = sc.order.PushFront(&suggestionCacheEntry{key, call.value})
+		for sc.order.Len() > sc.size {
+			oldest := sc.order.Back()
+			sc.order.Remove(oldest)
+			delete(sc.entries, oldest.Value.(*suggestionCacheEntry).key)
+		}
+	}
+	sc.mu.Unlock()
+	close(call.done)
+}
+
+// Purge drops every entry, for when ranking or synonyms change. Requests
+// computing meanwhile still get their response, but later ones do not
+// wait for it and it is not stored.
+func (sc *SuggestionCache) Purge() {
+	if sc == nil {
+		return
+	}
+	sc.mu.Lock()
+	sc.order.Init()
+	sc.entries = map[string]*list.Element{}
+	sc.calls = map[string]*suggestionCall{}
+	sc.generation++
+	sc.mu.Unlock()
+}
+
+// renderSuggestions serializes groups and derives their ETag.
+func renderSuggestions(groups []SuggestionGroup, counts map[string]int) *cachedSuggestions {
+	body, err := json.Marshal(groups)
+	if err != nil {
+		fmt.Println("Unable to render suggestions:", err)
+		return nil
+	}
+	sum := sha1.Sum(body)
+	return &cachedSuggestions{Body: body, ETag: `"` + hex.EncodeToString(sum[:8]) + `"`, Counts: counts}
+}
+
+// maxAge is the Cache-Control max-age matching the cache TTL.
+func (sc *SuggestionCache) maxAge() int {
+	if sc == nil {
+		return 0
+	}
+	return int(sc.ttl / time.Second)
+}
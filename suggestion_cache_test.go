@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func cachedBody(body string) func(context.Context) *cachedSuggestions {
+	return func(context.Context) *cachedSuggestions { return &cachedSuggestions{Body: []byte(body)} }
+}
+
+func TestSuggestionCacheLRU(t *testing.T) {
+	sc := newSuggestionCache(2, time.Minute)
+	sc.Get(context.Background(), "a", cachedBody("a"))
+	sc.Get(context.Background(), "b", cachedBody("b"))
+	sc.Get(context.Background(), "a", cachedBody("a")) // a is now the most recently used
+	sc.Get(context.Background(), "c", cachedBody("c")) // evicts b
+
+	for _, tt := range []struct {
+		key string
+		hit bool
+	}{
+		{"a", true},
+		{"c", true},
+		{"b", false},
+	} {
+		if _, hit := sc.Get(context.Background(), tt.key, cachedBody(tt.key)); hit != tt.hit {
+			t.Errorf("Get(%q) hit = %v, want %v", tt.key, hit, tt.hit)
+		}
+	}
+}
+
+func TestSuggestionCacheTTL(t *testing.T) {
+	sc := newSuggestionCache(10, 10*time.Millisecond)
+	sc.Get(context.Background(), "a", cachedBody("old"))
+	if value, hit := sc.Get(context.Background(), "a", cachedBody("new")); !hit || string(value.Body) != "old" {
+		t.Fatalf("fresh Get = %q, %v; want \"old\", true", value.Body, hit)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if value, hit := sc.Get(context.Background(), "a", cachedBody("new")); hit || string(value.Body) != "new" {
+		t.Errorf("expired Get = %q, %v; want \"new\", false", value.Body, hit)
+	}
+}
+
+func TestSuggestionCachePartial(t *testing.T) {
+	sc := newSuggestionCache(10, time.Minute)
+	sc.Get(context.Background(), "a", func(context.Context) *cachedSuggestions { return &cachedSuggestions{partial: true} })
+	if _, hit := sc.Get(context.Background(), "a", cachedBody("a")); hit {
+		t.Error("a partial response was cached")
+	}
+}
+
+func TestSuggestionCacheCoalescing(t *testing.T) {
+	sc := newSuggestionCache(10, time.Minute)
+	computing, release := make(chan struct{}), make(chan struct{})
+	var computed int32
+	compute := func(context.Context) *cachedSuggestions {
+		if atomic.AddInt32(&computed, 1) == 1 {
+			close(computing)
+		}
+		<-release
+		return &cachedSuggestions{Body: []byte("a")}
+	}
+
+	const callers = 8
+	var wg sync.WaitGroup
+	bodies := make([]string, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			value, _ := sc.Get(context.Background(), "a", compute)
+			bodies[i] = string(value.Body)
+		}(i)
+	}
+	<-computing
+	time.Sleep(10 * time.Millisecond) // let the others queue up behind it
+	close(release)
+	wg.Wait()
+
+	if computed != 1 {
+		t.Errorf("computed %d times, want 1", computed)
+	}
+	for i, body := range bodies {
+		if body != "a" {
+			t.Errorf("caller %d got %q, want \"a\"", i, body)
+		}
+	}
+}
+
+func TestSuggestionCachePurgeDuringCompute(t *testing.T) {
+	sc := newSuggestionCache(10, time.Minute)
+	computing, release := make(chan struct{}), make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sc.Get(context.Background(), "a", func(context.Context) *cachedSuggestions {
+			close(computing)
+			<-release
+			return &cachedSuggestions{Body: []byte("stale")}
+		})
+	}()
+	<-computing
+	sc.Purge()
+	close(release)
+	<-done
+
+	if value, hit := sc.Get(context.Background(), "a", cachedBody("fresh")); hit || string(value.Body) != "fresh" {
+		t.Errorf("Get after purge = %q, %v; want \"fresh\", false", value.Body, hit)
+	}
+}
+
+func TestSuggestionCacheCancel(t *testing.T) {
+	sc := newSuggestionCache(10, time.Minute)
+	computing, cancelled := make(chan struct{}), make(chan struct{})
+	compute := func(ctx context.Context) *cachedSuggestions {
+		close(computing)
+		<-ctx.Done()
+		close(cancelled)
+		return &cachedSuggestions{Body: []byte("cancelled")}
+	}
+
+	first, cancelFirst := context.WithCancel(context.Background())
+	second, cancelSecond := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	values := make([]*cachedSuggestions, 2)
+	wg.Add(2)
+	go func() { defer wg.Done(); values[0], _ = sc.Get(first, "a", compute) }()
+	<-computing
+	go func() { defer wg.Done(); values[1], _ = sc.Get(second, "a", compute) }()
+	time.Sleep(10 * time.Millisecond) // let the second one join
+
+	cancelFirst()
+	select {
+	case <-cancelled:
+		t.Fatal("the computation was cancelled while a caller still waited")
+	case <-time.After(10 * time.Millisecond):
+	}
+	cancelSecond()
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("the computation outlived its callers")
+	}
+	wg.Wait()
+
+	for i, value := range values {
+		if value != nil {
+			t.Errorf("caller %d got %q, want nil", i, value.Body)
+		}
+	}
+	if _, hit := sc.Get(context.Background(), "a", cachedBody("a")); hit {
+		t.Error("a cancelled computation was cached")
+	}
+}
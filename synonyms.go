@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TextSearchConfig maps a query language to the Postgres text search
+// configuration its terms are parsed with.
+type TextSearchConfig struct {
+	Hebrew  string `yaml:"hebrew"`
+	English string `yaml:"english"`
+}
+
+var defaultTextSearch = TextSearchConfig{Hebrew: "simple", English: "english"}
+
+var textSearchConfigName = regexp.MustCompile(`^[a-z_]+$`)
+
+func (t TextSearchConfig) validate() error {
+	for _, name := range []string{t.Hebrew, t.English} {
+		if !textSearchConfigName.MatchString(name) {
+			return fmt.Errorf("text_search: bad configuration name %q", name)
+		}
+	}
+	return nil
+}
+
+// configFor picks the text search configuration by the script of term.
+func (t TextSearchConfig) configFor(term string) string {
+	for _, ch := range term {
+		if ch >= 'א' && ch <= 'ת' {
+			return t.Hebrew
+		}
+	}
+	return t.English
+}
+
+const synonymsRefreshInterval = 5 * time.Minute
+
+var (
+	synonymsMu sync.RWMutex
+	synonyms   = map[string][]string{}
+)
+
+func prepareSynonyms() {
+	loadSynonyms()
+
+	go func() {
+		for range time.Tick(synonymsRefreshInterval) {
+			loadSynonyms()
+		}
+	}()
+}
+
+// loadSynonyms replaces the in-memory synonyms with the table contents.
+// Synonyms work both ways, so each row is registered in both directions.
+func loadSynonyms() {
+	type Row struct {
+		Term    string `db:"term"`
+		Synonym string `db:"synonym"`
+	}
+	rows := []Row{}
+	if err := dbx.Select(&rows, `SELECT term, synonym FROM search_synonyms`); err != nil {
+		fmt.Println("Unable to load synonyms:", err)
+		return
+	}
+
+	loaded := map[string][]string{}
+	for _, r := range rows {
+		term, synonym := normalizeTerm(r.Term), normalizeTerm(r.Synonym)
+		loaded[term] = append(loaded[term], synonym)
+		loaded[synonym] = append(loaded[synonym], term)
+	}
+
+	synonymsMu.Lock()
+	synonyms = loaded
+	synonymsMu.Unlock()
+}
+
+func synonymsFor(term string) []string {
+	synonymsMu.RLock()
+	defer synonymsMu.RUnlock()
+	return synonyms[normalizeTerm(term)]
+}
+
+func normalizeTerm(term string) string {
+	return strings.Join(strings.Fields(strings.ToLower(term)), " ")
+}
+
+// adminAuth guards the admin API with the ADMIN_TOKEN bearer token. The API
+// is disabled when no token is configured.
+func adminAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !isAdmin(c) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		c.Next()
+	}
+}
+
+func isAdmin(c *gin.Context) bool {
+	token := config.AdminToken
+	return token != "" && c.GetHeader("Authorization") == "Bearer "+token
+}
+
+func listSynonyms(c *gin.Context) {
+	type Row struct {
+		Term    string `db:"term" json:"term"`
+		Synonym string `db:"synonym" json:"synonym"`
+	}
+	rows := []Row{}
+	if err := dbx.Select(&rows, `SELECT term, synonym FROM search_synonyms ORDER BY term, synonym`); err != nil {
+		fmt.Println("list synonyms error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to list synonyms"})
+		return
+	}
+
+	grouped := map[string][]string{}
+	for _, r := range rows {
+		grouped[r.Term] = append(grouped[r.Term], r.Synonym)
+	}
+	c.JSON(http.StatusOK, grouped)
+}
+
+// putSynonyms replaces the synonyms of a term.
+func putSynonyms(c *gin.Context) {
+	var body struct {
+		Synonyms []string `json:"synonyms" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	term := normalizeTerm(c.Param("term"))
+	if term == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "empty term"})
+		return
+	}
+
+	tx, err := dbx.Beginx()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to save synonyms"})
+		return
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(`DELETE FROM search_synonyms WHERE term = $1`, term); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to save synonyms"})
+		return
+	}
+	saved := []string{}
+	for _, s := range body.Synonyms {
+		s = normalizeTerm(s)
+		if s == "" || s == term {
+			continue
+		}
+		if _, err = tx.Exec(`INSERT INTO search_synonyms (term, synonym) VALUES ($1, $2) ON CONFLICT DO NOTHING`, term, s); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to save synonyms"})
+			return
+		}
+		saved = append(saved, s)
+	}
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to save synonyms"})
+		return
+	}
+	loadSynonyms()
+	suggestionCache.Purge()
+
+	sort.Strings(saved)
+	c.JSON(http.StatusOK, gin.H{term: saved})
+}
+
+func deleteSynonyms(c *gin.Context) {
+	term := normalizeTerm(c.Param("term"))
+	if _, err := dbx.Exec(`DELETE FROM search_synonyms WHERE term = $1`, term); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to delete synonyms"})
+		return
+	}
+	loadSynonyms()
+	suggestionCache.Purge()
+	c.Status(http.StatusNoContent)
+}
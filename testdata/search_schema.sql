@@ -0,0 +1,78 @@
+-- The part of the shop schema the suggestion searches touch, for running
+-- backend_test.go against TEST_DATABASE_URL. It is created in a scratch
+-- schema first on the search_path, dropped after the test.
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE TABLE products (
+	id integer PRIMARY KEY,
+	title varchar,
+	system_name varchar,
+	vacation boolean NOT NULL DEFAULT false,
+	ready boolean NOT NULL DEFAULT true,
+	visible boolean NOT NULL DEFAULT true,
+	valid_from timestamp,
+	valid_until timestamp,
+	quantity_bought integer NOT NULL DEFAULT 0,
+	price numeric,
+	tsv tsvector
+);
+
+CREATE TABLE shop_sales (
+	id integer PRIMARY KEY,
+	hidden boolean NOT NULL DEFAULT false,
+	status varchar NOT NULL DEFAULT 'READY',
+	start_date timestamp,
+	end_date timestamp
+);
+
+CREATE TABLE shop_products (
+	id integer PRIMARY KEY,
+	title varchar,
+	sale_id integer REFERENCES shop_sales,
+	delivery_product boolean NOT NULL DEFAULT false,
+	tsv tsvector
+);
+
+CREATE TABLE shop_option_types (
+	id serial PRIMARY KEY,
+	product_id integer REFERENCES shop_products
+);
+
+CREATE TABLE shop_catalogs (
+	id serial PRIMARY KEY,
+	option_type_id integer REFERENCES shop_option_types,
+	quantity_bought integer NOT NULL DEFAULT 0,
+	price numeric
+);
+
+CREATE TABLE categories (
+	id integer PRIMARY KEY,
+	name varchar,
+	system_name varchar,
+	ancestry varchar,
+	is_active boolean NOT NULL DEFAULT true
+);
+
+CREATE TABLE sub_categories (
+	id integer PRIMARY KEY,
+	name varchar,
+	system_name varchar
+);
+
+CREATE TABLE categories_sub_categories (
+	category_id integer,
+	sub_category_id integer,
+	priority integer
+);
+
+CREATE TABLE products_sub_categories (
+	product_id integer,
+	sub_category_id integer
+);
+
+CREATE TABLE shop_products_sub_categories (
+	product_id integer,
+	sub_category_id integer
+);
+
+INSERT INTO sub_categories (id, system_name) VALUES (1, 'final-sale');
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Vertical is one group of suggestions in the autocomplete dropdown:
+// which table it searches, how many ids it takes, how they are ordered
+// and where each suggestion links to.
+type Vertical struct {
+	Name    string `yaml:"name"`
+	Heading string `yaml:"heading"`
+	Source  string `yaml:"source"` // products, shop_products or categories
+	Where   string `yaml:"where"`  // extra SQL condition on the source table
+	Limit   int    `yaml:"limit"`
+	Order   string `yaml:"order"` // rank or newest
+	Href    string `yaml:"href"`  // text/template over SearchSuggestion
+
+	// SeeAllHref and SeeAllLabel are text/templates over SeeAllLink and
+	// render the trailing "see all N results" entry of the group.
+	SeeAllHref  string `yaml:"see_all_href"`
+	SeeAllLabel string `yaml:"see_all_label"`
+
+	href        *template.Template
+	seeAllHref  *template.Template
+	seeAllLabel *template.Template
+}
+
+// SeeAllLink is what the see_all_href and see_all_label templates are
+// rendered against.
+type SeeAllLink struct {
+	Term     string
+	Vertical string
+	Total    int
+}
+
+type Verticals []*Vertical
+
+const (
+	sourceProducts     = "products"
+	sourceShopProducts = "shop_products"
+	sourceCategories   = "categories"
+
+	orderRank   = "rank"
+	orderNewest = "newest"
+
+	defaultSeeAllHref  = "/search?term={{urlquery .Term}}&vertical={{urlquery .Vertical}}"
+	defaultSeeAllLabel = "See all {{.Total}} results"
+)
+
+// defaultVerticals is the verticals.yml shipped with the code, used when
+// VERTICALS_FILE does not exist.
+//
+//go:embed verticals.yml
+var defaultVerticals string
+
+// SearchConfig is the contents of the verticals file.
+type SearchConfig struct {
+	Verticals  Verticals        `yaml:"verticals"`
+	Fuzzy      FuzzyConfig      `yaml:"fuzzy"`
+	TextSearch TextSearchConfig `yaml:"text_search"`
+	Ranking    RankingWeights   `yaml:"ranking"`
+}
+
+var (
+	verticals  Verticals
+	fuzzy      FuzzyConfig
+	textSearch = defaultTextSearch
+)
+
+// loadSearchConfig reads the verticals file from path, falling back to the
+// built-in defaults when the file does not exist.
+func loadSearchConfig(path string) (cfg SearchConfig, err error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		data, err = []byte(defaultVerticals), nil
+	}
+	if err != nil {
+		return
+	}
+	return parseSearchConfig(data)
+}
+
+func parseSearchConfig(data []byte) (cfg SearchConfig, err error) {
+	cfg.Fuzzy, cfg.TextSearch, cfg.Ranking = defaultFuzzy, defaultTextSearch, defaultRanking
+	if err = yaml.Unmarshal(data, &cfg); err != nil {
+		return
+	}
+	if err = cfg.Fuzzy.validate(); err != nil {
+		return
+	}
+	if err = cfg.TextSearch.validate(); err != nil {
+		return
+	}
+	if err = cfg.Ranking.validate(); err != nil {
+		return
+	}
+	if len(cfg.Verticals) == 0 {
+		err = fmt.Errorf("no verticals defined")
+		return
+	}
+
+	seen := map[string]bool{}
+	for _, v := range cfg.Verticals {
+		if v.Name == "" {
+			err = fmt.Errorf("vertical without a name")
+			return
+		}
+		if seen[v.Name] {
+			err = fmt.Errorf("vertical %q defined twice", v.Name)
+			return
+		}
+		seen[v.Name] = true
+		if v.Heading == "" {
+			v.Heading = v.Name
+		}
+		if v.Source != sourceProducts && v.Source != sourceShopProducts && v.Source != sourceCategories {
+			err = fmt.Errorf("vertical %q: unknown source %q", v.Name, v.Source)
+			return
+		}
+		if v.Source == sourceCategories && v.Where != "" {
+			err = fmt.Errorf("vertical %q: categories take no where", v.Name)
+			return
+		}
+		if v.Order == "" {
+			v.Order = orderRank
+		}
+		if v.Order != orderRank && v.Order != orderNewest {
+			err = fmt.Errorf("vertical %q: unknown order %q", v.Name, v.Order)
+			return
+		}
+		if v.SeeAllHref == "" && v.Source != sourceCategories {
+			v.SeeAllHref = defaultSeeAllHref // /search lists products only
+		}
+		if v.SeeAllLabel == "" {
+			v.SeeAllLabel = defaultSeeAllLabel
+		}
+		if v.href, err = parseVerticalTemplate(v, "href", v.Href); err != nil {
+			return
+		}
+		if v.SeeAllHref != "" {
+			if v.seeAllHref, err = parseVerticalTemplate(v, "see_all_href", v.SeeAllHref); err != nil {
+				return
+			}
+		}
+		if v.seeAllLabel, err = parseVerticalTemplate(v, "see_all_label", v.SeeAllLabel); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Select returns the verticals named in a comma separated list, keeping
+// the configured order. An empty list selects all of them.
+func (vs Verticals) Select(names string) (result Verticals) {
+	if names == "" {
+		return vs
+	}
+	wanted := map[string]bool{}
+	for _, n := range strings.Split(names, ",") {
+		wanted[strings.TrimSpace(n)] = true
+	}
+	for _, v := range vs {
+		if wanted[v.Name] {
+			result = append(result, v)
+		}
+	}
+	return
+}
+
+func parseVerticalTemplate(v *Vertical, field, text string) (t *template.Template, err error) {
+	if t, err = template.New(v.Name + "." + field).Option("missingkey=error").Parse(text); err != nil {
+		err = fmt.Errorf("vertical %q: bad %s: %v", v.Name, field, err)
+	}
+	return
+}
+
+func executeVerticalTemplate(t *template.Template, data interface{}) string {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		fmt.Println("vertical template error:", err)
+		return ""
+	}
+	return buf.String()
+}
+
+func (v *Vertical) HrefFor(s SearchSuggestion) string {
+	return executeVerticalTemplate(v.href, s)
+}
+
+// SeeAllFor builds the "see all N results" entry for a term, if the
+// vertical has somewhere to list them.
+func (v *Vertical) SeeAllFor(term string, total int) (seeAll Suggestion, ok bool) {
+	if v.seeAllHref == nil {
+		return
+	}
+	link := SeeAllLink{Term: term, Vertical: v.Name, Total: total}
+	return Suggestion{
+		Href:  executeVerticalTemplate(v.seeAllHref, link),
+		Label: executeVerticalTemplate(v.seeAllLabel, link),
+	}, true
+}